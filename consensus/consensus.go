@@ -25,3 +25,35 @@ func Del(p Proposer, path string, rev int64) (e store.Event) {
 
 	return p.Propose([]byte(e.Mut))
 }
+
+// Deltree proposes deleting path and everything under it; see
+// store.EncodeDeltree.
+func Deltree(p Proposer, path string, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeDeltree(path, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+// Seq proposes creating a new file, whose path starts with prefix, holding
+// body; see store.EncodeSeq. The path is in the event.
+func Seq(p Proposer, prefix string, body []byte) (e store.Event) {
+	e.Mut, e.Err = store.EncodeSeq(prefix, string(body))
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+// Multi proposes muts as a single change; see store.EncodeMulti.
+func Multi(p Proposer, muts []string) (e store.Event) {
+	e.Mut, e.Err = store.EncodeMulti(muts...)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
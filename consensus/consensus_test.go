@@ -52,17 +52,11 @@ func TestConsensusOne(t *testing.T) {
 	props <- &Prop{n, []byte("foo")}
 	e := <-w
 
-	exp := store.Event{
-		Seqn: 3,
-		Path: "/ctl/err",
-		Body: "bad mutation",
-		Rev:  3,
-		Mut:  "foo",
-		Err:  errors.New("bad mutation"),
-	}
-
-	e.Getter = nil
-	assert.Equal(t, exp, e)
+	assert.Equal(t, int64(3), e.Seqn)
+	assert.Equal(t, "foo", e.Mut)
+	assert.Equal(t, errors.New("bad mutation"), e.Err)
+	assert.Equal(t, "bad mutation", store.GetString(e.Getter, "/ctl/err/3/err"))
+	assert.Equal(t, "foo", store.GetString(e.Getter, "/ctl/err/3/mut"))
 }
 
 func TestConsensusTwo(t *testing.T) {
@@ -150,15 +144,9 @@ func TestConsensusTwo(t *testing.T) {
 	aprops <- &Prop{n, []byte("foo")}
 	e := <-w
 
-	exp := store.Event{
-		Seqn: 6,
-		Path: "/ctl/err",
-		Body: "bad mutation",
-		Rev:  6,
-		Mut:  "foo",
-		Err:  errors.New("bad mutation"),
-	}
-
-	e.Getter = nil
-	assert.Equal(t, exp, e)
+	assert.Equal(t, int64(6), e.Seqn)
+	assert.Equal(t, "foo", e.Mut)
+	assert.Equal(t, errors.New("bad mutation"), e.Err)
+	assert.Equal(t, "bad mutation", store.GetString(e.Getter, "/ctl/err/6/err"))
+	assert.Equal(t, "foo", store.GetString(e.Getter, "/ctl/err/6/mut"))
 }
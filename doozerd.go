@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	_ "expvar"
 	"flag"
 	"fmt"
 	"github.com/ha/doozer"
+	"github.com/ha/doozerd/dump"
 	"github.com/ha/doozerd/peer"
+	"github.com/ha/doozerd/server"
+	"github.com/ha/doozerd/store"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -39,6 +46,15 @@ var (
 	hi          = flag.Int64("hist", 2000, "length of history/revisions to keep")
 	certFile    = flag.String("tlscert", "", "TLS public certificate")
 	keyFile     = flag.String("tlskey", "", "TLS private key")
+	clientCA    = flag.String("tlsclientca", "", "CA certificates to require and verify client certificates against")
+	dataDir     = flag.String("data", "", "directory for the write-ahead log (default: keep data in memory only)")
+	si          = flag.Float64("snap", 300, "how often (in seconds) to snapshot the store into -data")
+	textMut     = flag.Bool("textmut", false, "propose changes in the old text form (while upgrading a cluster)")
+	plainAccess = flag.Bool("plainaccess", true, "let clients without TLS send secrets in the clear with ACCESS")
+	maxValue    = flag.Int64("maxvalue", 0, "most bytes clients may set a file to (0 means no limit)")
+	maxDepth    = flag.Int("maxdepth", 0, "most names in a path clients may set (0 means no limit)")
+	maxKeys     = flag.Int64("maxkeys", 0, "most files clients may store, outside /ctl (0 means no limit)")
+	maxBytes    = flag.Int64("maxbytes", 0, "most bytes clients may store, outside /ctl (0 means no limit)")
 )
 
 var (
@@ -52,12 +68,25 @@ func init() {
 
 func Usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [OPTIONS] dump [REV]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [OPTIONS] restore FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s hash\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, `
 The default for -w is to use the addr from -l,
 and change the port to 8000. If you give "-w false",
 doozerd will not listen for for web connections.
+
+With dump, doozerd writes the files in the cluster at the
+first -a addr (or at -l), as of REV (default: the current
+rev), to standard output. With restore, doozerd starts a
+new cluster, as usual, and sets the files in FILE, a dump,
+in it before accepting writes from clients.
+
+With hash, doozerd reads a secret from the first line of
+standard input and writes it hashed, as it must be stored
+in /ctl/acl/<name>/secret, to standard output.
 `)
 }
 
@@ -72,12 +101,34 @@ func main() {
 		return
 	}
 
+	var restore *dump.Decoder
+	switch flag.Arg(0) {
+	case "":
+	case "dump":
+		writeDump(flag.Arg(1))
+		return
+	case "hash":
+		writeHash()
+		return
+	case "restore":
+		restore = readDump(flag.Arg(1))
+		if len(aaddrs) > 0 {
+			fmt.Fprintln(os.Stderr, "restore starts a new cluster; it can't attach with -a")
+			os.Exit(1)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if *laddr == "" {
 		fmt.Fprintln(os.Stderr, "require a listen address")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	store.TextMutations = *textMut
+
 	log.SetPrefix("DOOZER ")
 	log.SetFlags(log.Ldate | log.Lmicroseconds)
 
@@ -86,8 +137,8 @@ func main() {
 		panic(err)
 	}
 
-	if *certFile != "" || *keyFile != "" {
-		tsock = tlsWrap(tsock, *certFile, *keyFile)
+	if *certFile != "" || *keyFile != "" || *clientCA != "" {
+		tsock = tlsWrap(tsock, *certFile, *keyFile, *clientCA)
 	}
 
 	uaddr, err := net.ResolveUDPAddr("udp", *laddr)
@@ -133,15 +184,108 @@ func main() {
 		cl = boot(*name, id, *laddr, *buri)
 	}
 
-	peer.Main(*name, id, *buri, rwsk, rosk, cl, usock, tsock, wsock, ns(*pi), ns(*fd), ns(*kt), *hi)
+	if restore != nil && cl != nil {
+		fmt.Fprintln(os.Stderr, "restore starts a new cluster, but cluster", *name, "exists")
+		os.Exit(1)
+	}
+
+	lim := server.Limits{*maxValue, *maxDepth, *maxKeys, *maxBytes}
+	peer.Main(*name, id, *buri, rwsk, rosk, *plainAccess, cl, usock, tsock, wsock, ns(*pi), ns(*fd), ns(*kt), *hi, *dataDir, ns(*si), lim, restore)
 	panic("main exit")
 }
 
+// Writes a dump of revision rev (or of the current revision, if rev is
+// empty) of the cluster to standard output.
+func writeDump(rev string) {
+	addr := *laddr
+	if len(aaddrs) > 0 {
+		addr = aaddrs[0]
+	}
+
+	cl, err := doozer.Dial(addr)
+	if err != nil {
+		panic(err)
+	}
+
+	// Only the read-write secret can read the hashed secrets in /ctl.
+	if rosk != "" || rwsk != "" {
+		sk := rwsk
+		if sk == "" {
+			sk = rosk
+		}
+		if err := cl.Access(sk); err != nil {
+			panic(err)
+		}
+	}
+
+	var n int64
+	if rev == "" {
+		n, err = cl.Rev()
+	} else {
+		n, err = strconv.ParseInt(rev, 10, 64)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	evs, err := cl.Walk("/**", n, 0, -1)
+	if err != nil {
+		panic(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	e, err := dump.NewEncoder(w, n)
+	if err != nil {
+		panic(err)
+	}
+	for _, ev := range evs {
+		if err := e.Encode(dump.File{ev.Path, ev.Body, ev.Rev}); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Writes the secret on the first line of standard input, hashed, to
+// standard output.
+func writeHash() {
+	sk, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	if n := len(sk); n > 0 && sk[n-1] == '\n' {
+		sk = sk[:n-1]
+	}
+	fmt.Println(server.HashSecret(sk))
+}
+
+func readDump(name string) *dump.Decoder {
+	if name == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+
+	d, err := dump.NewDecoder(bufio.NewReader(f))
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
 func ns(x float64) int64 {
 	return int64(x * 1e9)
 }
 
-func tlsWrap(l net.Listener, cfile, kfile string) net.Listener {
+// If cafile is not "", clients must present a certificate signed by one
+// of the CAs in it.
+func tlsWrap(l net.Listener, cfile, kfile, cafile string) net.Listener {
 	if cfile == "" || kfile == "" {
 		panic("need both cert file and key file")
 	}
@@ -153,5 +297,17 @@ func tlsWrap(l net.Listener, cfile, kfile string) net.Listener {
 
 	tc := new(tls.Config)
 	tc.Certificates = append(tc.Certificates, cert)
+
+	if cafile != "" {
+		pem, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			panic(err)
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			panic("no certificates in " + cafile)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 	return tls.NewListener(l, tc)
 }
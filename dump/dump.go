@@ -0,0 +1,172 @@
+// Package dump writes the files in a doozer tree, as of one revision, in a
+// portable form, and restores them into another tree.
+//
+// A dump is a stream of JSON objects, one per line. The first is a header
+// giving the revision of the dump:
+//
+//	{"rev":42}
+//
+// Each of the rest is a file, in order of path, with its body in base64
+// and the revision it had:
+//
+//	{"path":"/app/config","body":"aGVsbG8=","rev":17}
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/store"
+	"io"
+	"strings"
+)
+
+// How many files Restore sets in each change.
+const batchSize = 100
+
+// The files in /ctl that describe the cluster that was dumped, or what it
+// was doing, rather than the data in it. Restore skips them. The rest of
+// /ctl, such as the ACLs, secrets and quotas, is restored.
+var skipped = []string{
+	"/ctl/boot",
+	"/ctl/cal",
+	"/ctl/err",
+	"/ctl/name",
+	"/ctl/node",
+	"/ctl/ns",
+	"/ctl/session",
+	"/ctl/ttl",
+}
+
+var ErrBadDump = errors.New("bad dump")
+
+type header struct {
+	Rev int64 `json:"rev"`
+}
+
+// A File is one file in a dump.
+type File struct {
+	Path string `json:"path"`
+	Body []byte `json:"body"`
+	Rev  int64  `json:"rev"`
+}
+
+// An Encoder writes a dump.
+type Encoder struct {
+	e *json.Encoder
+}
+
+// NewEncoder writes the header of a dump of revision rev to w, and returns
+// an Encoder to write its files with.
+func NewEncoder(w io.Writer, rev int64) (*Encoder, error) {
+	e := json.NewEncoder(w)
+	if err := e.Encode(header{rev}); err != nil {
+		return nil, err
+	}
+	return &Encoder{e}, nil
+}
+
+// Encode writes f. Files should be written in order of path.
+func (e *Encoder) Encode(f File) error {
+	return e.e.Encode(f)
+}
+
+// Write writes a dump of every file in g, which is revision rev of a tree.
+func Write(w io.Writer, g store.Getter, rev int64) (err error) {
+	e, err := NewEncoder(w, rev)
+	if err != nil {
+		return err
+	}
+
+	store.Walk(g, store.Any, func(path, body string, rev int64) bool {
+		err = e.Encode(File{path, []byte(body), rev})
+		return err != nil
+	})
+	return err
+}
+
+// A Decoder reads a dump.
+type Decoder struct {
+	Rev int64 // the revision of the dump
+	d   *json.Decoder
+}
+
+// NewDecoder reads the header of the dump in r, and returns a Decoder to
+// read its files with.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	d := json.NewDecoder(r)
+	var h header
+	if err := d.Decode(&h); err != nil {
+		if err == io.EOF {
+			err = ErrBadDump
+		}
+		return nil, err
+	}
+	return &Decoder{h.Rev, d}, nil
+}
+
+// Decode returns the next file in the dump. At the end of the dump, the
+// error is io.EOF.
+func (d *Decoder) Decode() (f File, err error) {
+	err = d.d.Decode(&f)
+	if err == nil && f.Path == "" {
+		err = ErrBadDump
+	}
+	return f, err
+}
+
+// Restore sets each file read from d, through p, and returns how many it
+// set. Files under the paths in skipped are not set. Files are set
+// unconditionally, a batch at a time; if a batch fails, the files in it
+// and any after are not set, and the error is returned.
+func Restore(p consensus.Proposer, d *Decoder) (n int, err error) {
+	var muts []string
+	flush := func() error {
+		if len(muts) == 0 {
+			return nil
+		}
+		ev := consensus.Multi(p, muts)
+		if ev.Err != nil {
+			return ev.Err
+		}
+		n += len(muts)
+		muts = muts[:0]
+		return nil
+	}
+
+	for {
+		f, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if isSkipped(f.Path) {
+			continue
+		}
+
+		m, err := store.EncodeSet(f.Path, string(f.Body), store.Clobber)
+		if err != nil {
+			return n, err
+		}
+		muts = append(muts, m)
+
+		if len(muts) == batchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+func isSkipped(path string) bool {
+	for _, dir := range skipped {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package dump
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	st.Ops <- store.Op{1, store.MustEncodeSet("/b", "b", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/a/x", "hello", store.Clobber)}
+	<-st.Seqns
+
+	var buf bytes.Buffer
+	rev, g := st.Snap()
+	assert.Equal(t, nil, Write(&buf, g, rev))
+	assert.Equal(t, `{"rev":2}
+{"path":"/a/x","body":"aGVsbG8=","rev":2}
+{"path":"/b","body":"Yg==","rev":1}
+`, buf.String())
+}
+
+func TestRoundTrip(t *testing.T) {
+	a := store.New()
+	defer close(a.Ops)
+	a.Ops <- store.Op{1, store.MustEncodeSet("/ctl/name", "prod", store.Clobber)}
+	a.Ops <- store.Op{2, store.MustEncodeSet("/app/config", "\x00\xff=:", store.Clobber)}
+	a.Ops <- store.Op{3, store.MustEncodeSet("/ctl/acl/ops/secret", "sha256:00:00", store.Clobber)}
+	a.Ops <- store.Op{4, store.MustEncodeSet("/ctl/quota/q/path", "/q", store.Clobber)}
+	a.Ops <- store.Op{5, store.MustEncodeSet("/ctl/node/X/addr", "1.2.3.4:8046", store.Clobber)}
+	a.Ops <- store.Op{6, store.MustEncodeSet("/ctl/session/s/ttl", "1", store.Clobber)}
+	for i := 0; i < batchSize+5; i++ {
+		a.Ops <- store.Op{int64(7 + i), store.MustEncodeSet("/q/"+string('a'+rune(i%26))+"/"+strings.Repeat("n", i/26+1), "x", store.Clobber)}
+	}
+	<-a.Seqns
+
+	var buf bytes.Buffer
+	rev, g := a.Snap()
+	assert.Equal(t, nil, Write(&buf, g, rev))
+
+	b := store.New()
+	defer close(b.Ops)
+	d, err := NewDecoder(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, d.Rev)
+
+	n, err := Restore(&test.FakeProposer{Store: b}, d)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, batchSize+8, n)
+
+	assert.Equal(t, "\x00\xff=:", store.GetString(b, "/app/config"))
+	assert.Equal(t, "sha256:00:00", store.GetString(b, "/ctl/acl/ops/secret"))
+	assert.Equal(t, "/q", store.GetString(b, "/ctl/quota/q/path"))
+	for _, path := range []string{"/ctl/name", "/ctl/node/X/addr", "/ctl/session/s/ttl"} {
+		_, r := b.Get(path)
+		assert.Equal(t, store.Missing, r, path)
+	}
+
+	store.Walk(g, store.MustCompileGlob("/q/**"), func(path, body string, rev int64) bool {
+		assert.Equal(t, body, store.GetString(b, path), path)
+		return false
+	})
+}
+
+func TestDecodeBad(t *testing.T) {
+	_, err := NewDecoder(strings.NewReader(""))
+	assert.Equal(t, ErrBadDump, err)
+
+	d, err := NewDecoder(strings.NewReader(`{"rev":1}` + "\n" + `{"body":"YQ=="}`))
+	assert.Equal(t, nil, err)
+	_, err = d.Decode()
+	assert.Equal(t, ErrBadDump, err)
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	d, err := NewDecoder(strings.NewReader(`{"rev":7}` + "\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(7), d.Rev)
+	_, err = d.Decode()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,17 @@
+package gc
+
+import (
+	"github.com/ha/doozerd/store"
+	"log"
+	"time"
+)
+
+// Snapshot writes a snapshot of st to l on every tick, letting l discard
+// the parts of the log the snapshot covers.
+func Snapshot(st *store.Store, l *store.Log, ticker <-chan time.Time) {
+	for _ = range ticker {
+		if err := l.Snapshot(st); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package gc
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGcSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doozerd-gc")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	l, err := store.OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+
+	st := store.NewLogged(l)
+	defer close(st.Ops)
+
+	ticker := make(chan time.Time)
+	defer close(ticker)
+
+	go Snapshot(st, l, ticker)
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "a", store.Clobber)}
+	st.Ops <- store.Op{2, store.Nop}
+	<-st.Seqns
+
+	ticker <- time.Unix(0, 1)
+	ticker <- time.Unix(0, 1) // Extra tick to ensure the snapshot has completed
+
+	fs, err := ioutil.ReadDir(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(fs))
+	assert.Equal(t, "snap-00000000000000000002", fs[0].Name())
+}
@@ -8,6 +8,7 @@ GOFILES="
 	main.html.go
 	stats.html.go
 	main.js.go
+	diff.html.go
 "
 
 for f in $GOFILES
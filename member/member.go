@@ -4,6 +4,7 @@ import (
 	"github.com/ha/doozerd/consensus"
 	"github.com/ha/doozerd/store"
 	"log"
+	"sort"
 )
 
 var (
@@ -12,17 +13,31 @@ var (
 
 func Clean(c chan string, st *store.Store, p consensus.Proposer) {
 	for addr := range c {
-		_, g := st.Snap()
+		rev, g := st.Snap()
 		name := getName(addr, g)
 		if name != "" {
 			go func() {
 				clearSlot(p, g, name)
-				removeInfo(p, g, name)
+				removeInfo(p, rev, name)
 			}()
 		}
 	}
 }
 
+// IsFirst returns true if self holds the first occupied CAL slot in g.
+// Work that needs doing by exactly one node, such as proposing deletes
+// for expired files, is left to it.
+func IsFirst(g store.Getter, self string) bool {
+	slots := store.Getdir(g, "/ctl/cal")
+	sort.Strings(slots)
+	for _, slot := range slots {
+		if v := store.GetString(g, "/ctl/cal/"+slot); v != "" {
+			return v == self
+		}
+	}
+	return false
+}
+
 func getName(addr string, g store.Getter) string {
 	for _, name := range store.Getdir(g, "/ctl/node") {
 		if store.GetString(g, "/ctl/node/"+name+"/addr") == addr {
@@ -41,14 +56,10 @@ func clearSlot(p consensus.Proposer, g store.Getter, name string) {
 	})
 }
 
-func removeInfo(p consensus.Proposer, g store.Getter, name string) {
-	glob, err := store.CompileGlob("/ctl/node/" + name + "/**")
-	if err != nil {
-		log.Println(err)
-		return
+// Deletes everything under /ctl/node/name, unless it has changed since rev.
+func removeInfo(p consensus.Proposer, rev int64, name string) {
+	e := consensus.Deltree(p, "/ctl/node/"+name, rev)
+	if e.Err != nil {
+		log.Println(e.Err)
 	}
-	store.Walk(g, glob, func(path, _ string, rev int64) bool {
-		consensus.Del(p, path, rev)
-		return false
-	})
 }
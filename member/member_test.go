@@ -41,7 +41,9 @@ func TestMemberSimple(t *testing.T) {
 	ev = <-nodeCh
 	assert.T(t, ev.IsDel())
 	cs = append(cs, int(ev.Path[len(ev.Path)-1]))
-	nodeCh, err = fp.Wait(store.MustCompileGlob("/ctl/node/a/?"), ev.Seqn+1)
+
+	// the whole subtree goes in one change, so wait for its next file
+	nodeCh, err = fp.WaitSkip(store.MustCompileGlob("/ctl/node/a/?"), ev.Seqn, 1)
 	if err != nil {
 		panic(err)
 	}
@@ -53,3 +55,17 @@ func TestMemberSimple(t *testing.T) {
 	sort.Ints(cs)
 	assert.Equal(t, []int{'x', 'y'}, cs)
 }
+
+func TestMemberIsFirst(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	assert.T(t, !IsFirst(st, "a"))
+
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/0", "", store.Missing)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/1", "a", store.Missing)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/2", "b", store.Missing)))
+	assert.T(t, IsFirst(st, "a"))
+	assert.T(t, !IsFirst(st, "b"))
+	assert.T(t, !IsFirst(st, ""))
+}
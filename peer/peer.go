@@ -3,10 +3,13 @@ package peer
 import (
 	"github.com/ha/doozer"
 	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/dump"
 	"github.com/ha/doozerd/gc"
 	"github.com/ha/doozerd/member"
 	"github.com/ha/doozerd/server"
+	"github.com/ha/doozerd/session"
 	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/ttl"
 	"github.com/ha/doozerd/web"
 	"io"
 	"log"
@@ -29,9 +32,11 @@ type proposer struct {
 	seqns chan int64
 	props chan *consensus.Prop
 	st    *store.Store
+	self  string
 }
 
 func (p *proposer) Propose(v []byte) (e store.Event) {
+	v = []byte(store.WithProposer(string(v), p.self))
 	for e.Mut != string(v) {
 		n := <-p.seqns
 		w, err := p.st.Wait(store.Any, n)
@@ -44,23 +49,35 @@ func (p *proposer) Propose(v []byte) (e store.Event) {
 	return
 }
 
-func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *net.UDPConn, listener, webListener net.Listener, pulseInterval, fillDelay, kickTimeout int64, hi int64) {
+func Main(clusterName, self, buri, rwsk, rosk string, plainAccess bool, cl *doozer.Conn, udpConn *net.UDPConn, listener, webListener net.Listener, pulseInterval, fillDelay, kickTimeout int64, hi int64, dataDir string, snapInterval int64, lim server.Limits, restore *dump.Decoder) {
 	listenAddr := listener.Addr().String()
 
 	canWrite := make(chan bool, 1)
 	in := make(chan consensus.Packet, 50)
 	out := make(chan consensus.Packet, 50)
 
-	st := store.New()
+	var wal *store.Log
+	if dataDir != "" {
+		var err error
+		wal, err = store.OpenLog(dataDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	st := store.NewLogged(wal)
 	pr := &proposer{
 		seqns: make(chan int64, alpha),
 		props: make(chan *consensus.Prop),
 		st:    st,
+		self:  self,
 	}
 
 	calSrv := func(start int64) {
 		go gc.Pulse(self, st.Seqns, pr, pulseInterval)
 		go gc.Clean(st, hi, time.Tick(1e9))
+		go session.Expire(st, pr, self, time.Tick(1e9))
+		go ttl.Expire(st, pr, self, time.Tick(1e9))
 		var m consensus.Manager
 		m.Self = self
 		m.DefRev = start
@@ -76,19 +93,41 @@ func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *
 		go m.Run()
 	}
 
+	snapshot := func() {
+		if wal != nil {
+			go gc.Snapshot(st, wal, time.Tick(time.Duration(snapInterval)))
+		}
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown"
 	}
 
 	if cl == nil { // we are the only node in a new cluster
-		set(st, "/ctl/name", clusterName, store.Missing)
-		set(st, "/ctl/node/"+self+"/addr", listenAddr, store.Missing)
-		set(st, "/ctl/node/"+self+"/hostname", hostname, store.Missing)
-		set(st, "/ctl/node/"+self+"/version", Version, store.Missing)
-		set(st, "/ctl/cal/0", self, store.Missing)
+		rev := store.Missing
+		if wal != nil && recoverLog(st, wal) > 0 {
+			// We are restarting the cluster from our log. The other
+			// CALs in it are gone; free their slots so that new nodes
+			// can take them.
+			if name := store.GetString(st, "/ctl/name"); name != clusterName {
+				panic("log in " + dataDir + " belongs to cluster " + name)
+			}
+			for _, base := range store.Getdir(st, calDir) {
+				set(st, calDir+"/"+base, "", store.Clobber)
+			}
+			if restore != nil {
+				panic("can't restore into the cluster in " + dataDir)
+			}
+			rev = store.Clobber
+		}
+		set(st, "/ctl/name", clusterName, rev)
+		set(st, "/ctl/node/"+self+"/addr", listenAddr, rev)
+		set(st, "/ctl/node/"+self+"/hostname", hostname, rev)
+		set(st, "/ctl/node/"+self+"/version", Version, rev)
+		set(st, "/ctl/cal/0", self, rev)
 		if buri == "" {
-			set(st, "/ctl/ns/"+clusterName+"/"+self, listenAddr, store.Missing)
+			set(st, "/ctl/ns/"+clusterName+"/"+self, listenAddr, rev)
 		}
 		calSrv(<-st.Seqns)
 		// Skip ahead alpha steps so that the registrar can provide a
@@ -96,9 +135,34 @@ func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *
 		for i := 0; i < alpha; i++ {
 			st.Ops <- store.Op{1 + <-st.Seqns, store.Nop}
 		}
-		canWrite <- true
-		go setReady(pr, self)
+		snapshot()
+		if restore != nil {
+			go func() {
+				n, err := dump.Restore(pr, restore)
+				if err != nil {
+					panic(err)
+				}
+				log.Printf("restored %d files from rev %d", n, restore.Rev)
+				canWrite <- true
+				go setReady(pr, self)
+			}()
+		} else {
+			canWrite <- true
+			go setReady(pr, self)
+		}
 	} else {
+		if restore != nil {
+			panic("can't restore into an existing cluster")
+		}
+
+		// Our copy of the store will be cloned from the cluster, so
+		// anything left in the log is stale.
+		if wal != nil {
+			if err := wal.Reset(); err != nil {
+				panic(err)
+			}
+		}
+
 		setC(cl, "/ctl/node/"+self+"/addr", listenAddr, store.Clobber)
 		setC(cl, "/ctl/node/"+self+"/hostname", hostname, store.Clobber)
 		setC(cl, "/ctl/node/"+self+"/version", Version, store.Clobber)
@@ -109,7 +173,7 @@ func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *
 		}
 
 		stop := make(chan bool, 1)
-		go follow(st, cl, rev+1, stop)
+		go follow(st, dialCal(cl, rev, rwsk), rev+1, stop)
 
 		errs := make(chan error)
 		go func() {
@@ -118,14 +182,19 @@ func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *
 				panic(e)
 			}
 		}()
-		doozer.Walk(cl, rev, "/", cloner{st.Ops, cl, rev}, errs)
+		cn := &cloner{cl, rev, map[int64][]string{}}
+		doozer.Walk(cl, rev, "/", cn, errs)
 		close(errs)
+		for _, op := range cn.ops() {
+			st.Ops <- op
+		}
 		st.Flush()
 
 		ch, err := st.Wait(store.Any, rev+1)
 		if err == nil {
 			<-ch
 		}
+		snapshot()
 
 		go func() {
 			n := activate(st, self, cl)
@@ -151,11 +220,15 @@ func Main(clusterName, self, buri, rwsk, rosk string, cl *doozer.Conn, udpConn *
 
 	shun := make(chan string, 3) // sufficient for a cluster of 7
 	go member.Clean(shun, st, pr)
-	go server.ListenAndServe(listener, canWrite, st, pr, rwsk, rosk, self)
+	go server.ListenAndServe(listener, canWrite, st, pr, rwsk, rosk, plainAccess, self, lim)
 
 	if rwsk == "" && rosk == "" && webListener != nil {
 		web.Store = st
 		web.ClusterName = clusterName
+		web.Locked = func() bool {
+			_, g := st.Snap()
+			return server.SecretsKept(g)
+		}
 		go web.Serve(webListener)
 	}
 
@@ -260,6 +333,15 @@ func set(st *store.Store, path, body string, rev int64) {
 	st.Ops <- store.Op{1 + <-st.Seqns, mut}
 }
 
+// Rebuilds st from wal. Returns the seqn st is at afterward.
+func recoverLog(st *store.Store, wal *store.Log) int64 {
+	seqn, err := wal.Recover(st)
+	if err != nil {
+		panic(err)
+	}
+	return seqn
+}
+
 func setC(cl *doozer.Conn, path, body string, rev int64) {
 	_, err := cl.Set(path, rev, []byte(body))
 	if err != nil {
@@ -267,46 +349,122 @@ func setC(cl *doozer.Conn, path, body string, rev int64) {
 	}
 }
 
-func follow(st *store.Store, cl *doozer.Conn, rev int64, stop chan bool) {
+// Returns a connection, with the access of rwsk, to one of the CALs of
+// the cluster cl is connected to, as of rev.
+func dialCal(cl *doozer.Conn, rev int64, rwsk string) *server.Client {
+	names, err := cl.Getdir(calDir, rev, 0, -1)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range names {
+		id, _, err := cl.Get(calDir+"/"+name, &rev)
+		if err != nil || len(id) == 0 {
+			continue
+		}
+
+		addr, _, err := cl.Get("/ctl/node/"+string(id)+"/addr", &rev)
+		if err != nil {
+			panic(err)
+		}
+		c, err := net.Dial("tcp", string(addr))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sc := server.NewClient(c)
+		if err := sc.Access(rwsk); err != nil {
+			panic(err)
+		}
+		return sc
+	}
+	panic("no CAL to follow")
+}
+
+// Applies to st each change the cluster makes on or after rev, until
+// told to stop. A rev can change several files, and the store applies
+// only the first op it gets for each rev, so follow collects all the
+// changes made at a rev, passing over those it has seen, and applies them
+// as one op once it sees a change made after it.
+func follow(st *store.Store, cl *server.Client, rev int64, stop chan bool) {
+	var muts []string
 	for {
-		ev, err := cl.Wait("/**", rev)
+		ev, err := cl.Wait("/**", rev, int32(len(muts)))
 		if err != nil {
 			panic(err)
 		}
 
+		if ev.Seqn != rev {
+			if len(muts) > 0 {
+				st.Ops <- store.Op{rev, joinMuts(muts)}
+				muts = nil
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rev = ev.Seqn
+		}
+
 		// store.Clobber is okay here because the event
 		// has already passed through another store
-		mut := store.MustEncodeSet(ev.Path, string(ev.Body), store.Clobber)
-		st.Ops <- store.Op{ev.Rev, mut}
-		rev = ev.Rev + 1
-
-		select {
-		case <-stop:
-			return
-		default:
+		if ev.IsDel() {
+			muts = append(muts, store.MustEncodeDel(ev.Path, store.Clobber))
+		} else {
+			muts = append(muts, store.MustEncodeSet(ev.Path, ev.Body, store.Clobber))
 		}
 	}
 }
 
+// Returns a mutation that applies each of muts, in order, as one change.
+func joinMuts(muts []string) string {
+	if len(muts) == 1 {
+		return muts[0]
+	}
+	mut, err := store.EncodeMulti(muts...)
+	if err != nil {
+		panic(err)
+	}
+	return mut
+}
+
+// A cloner copies the files of a cluster, as of storeRev. The files last
+// changed at one rev must reach the store in a single op, as it applies
+// only the first op it gets for each rev; so cloner collects them, and
+// ops returns them once the walk is done.
 type cloner struct {
-	ch chan<- store.Op
-	cl *doozer.Conn
+	cl       *doozer.Conn
 	storeRev int64
+	muts     map[int64][]string // by the rev each file was last changed at
 }
 
-func (c cloner) VisitDir(path string, f *doozer.FileInfo) bool {
+func (c *cloner) VisitDir(path string, f *doozer.FileInfo) bool {
 	return true
 }
 
-func (c cloner) VisitFile(path string, f *doozer.FileInfo) {
-	// store.Clobber is okay here because the event
-	// has already passed through another store
+func (c *cloner) VisitFile(path string, f *doozer.FileInfo) {
 	body, _, err := c.cl.Get(path, &c.storeRev)
 	if err != nil {
 		panic(err)
 	}
-	mut := store.MustEncodeSet(path, string(body), store.Clobber)
-	c.ch <- store.Op{f.Rev, mut}
+	c.add(path, string(body), f.Rev)
+}
+
+// Records that the file at path had body, as of rev.
+func (c *cloner) add(path, body string, rev int64) {
+	// store.Clobber is okay here because the event
+	// has already passed through another store
+	c.muts[rev] = append(c.muts[rev], store.MustEncodeSet(path, body, store.Clobber))
+}
+
+// Returns an op for each rev files were recorded at.
+func (c *cloner) ops() (a []store.Op) {
+	for rev, muts := range c.muts {
+		a = append(a, store.Op{rev, joinMuts(muts)})
+	}
+	return a
 }
 
 func setReady(p consensus.Proposer, self string) {
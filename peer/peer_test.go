@@ -3,7 +3,10 @@ package peer
 import (
 	"github.com/bmizerany/assert"
 	"github.com/ha/doozer"
+	"github.com/ha/doozerd/server"
 	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"net"
 	"os/exec"
 
 	"testing"
@@ -16,7 +19,7 @@ func TestDoozerNop(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 	err := cl.Nop()
@@ -29,7 +32,7 @@ func TestDoozerGet(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -58,7 +61,7 @@ func TestDoozerSet(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -77,7 +80,7 @@ func TestDoozerGetWithRev(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -109,7 +112,7 @@ func TestDoozerWaitSimple(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 	var rev int64 = 1
@@ -143,7 +146,7 @@ func TestDoozerWaitWithRev(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -171,7 +174,7 @@ func TestDoozerStat(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -195,7 +198,7 @@ func TestDoozerGetdirOnDir(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -219,7 +222,7 @@ func TestDoozerGetdirOnFile(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -241,7 +244,7 @@ func TestDoozerGetdirMissing(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 
@@ -261,7 +264,7 @@ func TestDoozerGetdirOffsetLimit(t *testing.T) {
 	u := mustListenUDP(l.Addr().String())
 	defer u.Close()
 
-	go Main("a", "X", "", "", "", nil, u, l, nil, 1e9, 2e9, 3e9, 101)
+	go Main("a", "X", "", "", "", true, nil, u, l, nil, 1e9, 2e9, 3e9, 101, "", 0, server.Limits{}, nil)
 
 	cl := dial(l.Addr().String())
 	cl.Set("/test/a", store.Clobber, []byte("1"))
@@ -295,9 +298,9 @@ func TestPeerShun(t *testing.T) {
 	u2 := mustListenUDP(l2.Addr().String())
 	defer u2.Close()
 
-	go Main("a", "X", "", "", "", nil, u0, l0, nil, 1e8, 1e7, 1e9, 1e9)
-	go Main("a", "Y", "", "", "", dial(a0), u1, l1, nil, 1e8, 1e7, 1e9, 1e9)
-	go Main("a", "Z", "", "", "", dial(a0), u2, l2, nil, 1e8, 1e7, 1e9, 1e9)
+	go Main("a", "X", "", "", "", true, nil, u0, l0, nil, 1e8, 1e7, 1e9, 1e9, "", 0, server.Limits{}, nil)
+	go Main("a", "Y", "", "", "", true, dial(a0), u1, l1, nil, 1e8, 1e7, 1e9, 1e9, "", 0, server.Limits{}, nil)
+	go Main("a", "Z", "", "", "", true, dial(a0), u2, l2, nil, 1e8, 1e7, 1e9, 1e9, "", 0, server.Limits{}, nil)
 
 	cl := dial(l0.Addr().String())
 	cl.Set("/ctl/cal/1", store.Missing, nil)
@@ -338,7 +341,7 @@ func TestPeerLateJoin(t *testing.T) {
 	u1 := mustListenUDP(l1.Addr().String())
 	defer u1.Close()
 
-	go Main("a", "X", "", "", "", nil, u0, l0, nil, 1e8, 1e7, 1e9, 60)
+	go Main("a", "X", "", "", "", true, nil, u0, l0, nil, 1e8, 1e7, 1e9, 60, "", 0, server.Limits{}, nil)
 
 	cl := dial(l0.Addr().String())
 	waitFor(cl, "/ctl/node/X/writable")
@@ -348,7 +351,7 @@ func TestPeerLateJoin(t *testing.T) {
 	// so we can drop this down to something reasonable
 	time.Sleep(1100 * time.Millisecond)
 
-	go Main("a", "Y", "", "", "", dial(a0), u1, l1, nil, 1e8, 1e7, 1e9, 60)
+	go Main("a", "Y", "", "", "", true, dial(a0), u1, l1, nil, 1e8, 1e7, 1e9, 60, "", 0, server.Limits{}, nil)
 	rev, _ := cl.Set("/ctl/cal/1", store.Missing, nil)
 	for {
 		ev, err := cl.Wait("/ctl/node/Y/writable", rev)
@@ -362,6 +365,67 @@ func TestPeerLateJoin(t *testing.T) {
 	}
 }
 
+func TestClonerMultiFileRev(t *testing.T) {
+	c := &cloner{muts: map[int64][]string{}}
+	c.add("/a", "1", 2)
+	c.add("/b/c", "2", 2)
+	c.add("/d", "3", 1)
+
+	st := store.New()
+	defer close(st.Ops)
+	for _, op := range c.ops() {
+		st.Ops <- op
+	}
+	st.Flush()
+
+	v, rev := st.Get("/a")
+	assert.Equal(t, []string{"1"}, v)
+	assert.Equal(t, int64(2), rev)
+	v, rev = st.Get("/b/c")
+	assert.Equal(t, []string{"2"}, v)
+	assert.Equal(t, int64(2), rev)
+	v, rev = st.Get("/d")
+	assert.Equal(t, []string{"3"}, v)
+	assert.Equal(t, int64(1), rev)
+}
+
+func TestFollowMultiFileRev(t *testing.T) {
+	src := store.New()
+	defer close(src.Ops)
+	p := &test.FakeProposer{Store: src}
+	p.Propose([]byte(store.MustEncodeSet("/x", "0", store.Clobber)))
+	mut, err := store.EncodeMulti(
+		store.MustEncodeSet("/a", "1", store.Clobber),
+		store.MustEncodeSet("/b", "2", store.Clobber),
+		store.MustEncodeDel("/x", store.Clobber),
+	)
+	assert.Equal(t, nil, err)
+	p.Propose([]byte(mut))
+	p.Propose([]byte(store.MustEncodeSet("/c", "3", store.Clobber)))
+
+	l := mustListen()
+	defer l.Close()
+	go server.ListenAndServe(l, nil, src, p, "", "", true, "X", server.Limits{})
+	nc, err := net.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err)
+
+	st := store.New()
+	defer close(st.Ops)
+	go follow(st, server.NewClient(nc), 1, make(chan bool, 1))
+	ch, err := st.Wait(store.Any, 2)
+	assert.Equal(t, nil, err)
+	<-ch
+
+	v, rev := st.Get("/a")
+	assert.Equal(t, []string{"1"}, v)
+	assert.Equal(t, int64(2), rev)
+	v, rev = st.Get("/b")
+	assert.Equal(t, []string{"2"}, v)
+	assert.Equal(t, int64(2), rev)
+	_, rev = st.Get("/x")
+	assert.Equal(t, store.Missing, rev)
+}
+
 func assertDenied(t *testing.T, err error) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, doozer.ErrOther, err.(*doozer.Error).Err)
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/x509"
+	"github.com/ha/doozerd/store"
+	"sort"
+	"strings"
+)
+
+// Principals live in directories under aclDir, one for each, named for
+// the principal. In each, file secret holds the secret a client gives
+// with ACCESS to act as the principal, hashed (see HashSecret); file cert
+// holds names, one per line, any of which in a client's TLS certificate
+// makes it act as the principal; and files read and write hold the paths
+// of the subtrees it may read, and read and write, one per line.
+//
+// ACLs, secrets and names are read from the store as each request is
+// handled, so a change to one applies at once to every connection acting
+// as that principal. A connection whose principal no longer accepts the
+// secret or certificate it gave loses its access (see (*conn).recheck).
+const aclDir = "/ctl/acl"
+
+// The server's read-write and read-only secrets can be kept in the store
+// too, hashed like principals' secrets, in rwFile and roFile. Each that
+// is not empty takes the place of DOOZER_RWSECRET or DOOZER_ROSECRET on
+// every member, so they can be changed, and connections re-checked, like
+// principals' secrets.
+const (
+	secretDir = "/ctl/secret"
+	rwFile    = secretDir + "/rw"
+	roFile    = secretDir + "/ro"
+)
+
+// SecretsKept reports whether g keeps either of the server's secrets in
+// secretDir.
+func SecretsKept(g store.Getter) bool {
+	return serverCred(g, rwFile) != "" || serverCred(g, roFile) != ""
+}
+
+// Returns the hashed secret in file, in g, or "" if there is none.
+func serverCred(g store.Getter, file string) string {
+	return strings.TrimSpace(store.GetString(g, file))
+}
+
+// Reports whether path holds a hashed secret: one of the server's, or a
+// principal's. A hash is enough to guess the secret offline, so only
+// clients with the server's read-write secret may read these files, or
+// see that they exist.
+func isSecret(path string) bool {
+	if under(path, secretDir) {
+		return path != secretDir
+	}
+	if !strings.HasPrefix(path, aclDir+"/") {
+		return false
+	}
+	rest := path[len(aclDir)+1:]
+	i := strings.Index(rest, "/")
+	return i >= 0 && under(rest[i+1:], "secret")
+}
+
+// An acl is what a principal may do. A nil *acl may do anything. Any
+// other may not read or see secrets (see isSecret), whatever its subtrees.
+type acl struct {
+	read  []string // subtrees that may be read
+	write []string // subtrees that may be read and written
+}
+
+// The ACL of a client that doesn't act as a principal and doesn't have
+// the server's read-write secret.
+var readOnly = &acl{read: []string{""}}
+
+// Returns the ACL for principal name in g. If there is no such principal,
+// the ACL allows nothing.
+func getACL(g store.Getter, name string) *acl {
+	dir := aclDir + "/" + name
+	return &acl{
+		read:  aclPaths(store.GetString(g, dir+"/read")),
+		write: aclPaths(store.GetString(g, dir+"/write")),
+	}
+}
+
+func aclPaths(s string) (paths []string) {
+	for _, p := range strings.Split(s, "\n") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		p = strings.TrimRight(p, "/") // "/" becomes "", the root
+		if p == "" || store.CheckPath(p) == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Returns the principal whose secret is sk, and its hashed secret, or ""
+// if there is none. If name is not "", only that principal is tried.
+func findPrincipal(g store.Getter, name, sk string) (string, string) {
+	if strings.Contains(name, "/") {
+		return "", ""
+	}
+
+	names := []string{name}
+	if name == "" {
+		var rev int64
+		names, rev = g.Get(aclDir)
+		if rev != store.Dir {
+			return "", ""
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		cred := store.GetString(g, aclDir+"/"+name+"/secret")
+		if checkSecret(cred, sk) {
+			return name, cred
+		}
+	}
+	return "", ""
+}
+
+// Returns the names in cert that can be given in a principal's cert file:
+// its subject's common name, and its DNS and email alternative names.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
+
+// Returns the first principal, in order of name, whose cert file holds
+// one of names, or "" if there is none.
+func findCertPrincipal(g store.Getter, names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	ps, rev := g.Get(aclDir)
+	if rev != store.Dir {
+		return ""
+	}
+	sort.Strings(ps)
+	for _, p := range ps {
+		if certMatches(g, p, names) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Reports whether the cert file of principal name holds one of names.
+func certMatches(g store.Getter, name string, names []string) bool {
+	for _, line := range strings.Split(store.GetString(g, aclDir+"/"+name+"/cert"), "\n") {
+		line = strings.TrimSpace(line)
+		for _, n := range names {
+			if line != "" && line == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether path is dir or is in the tree under it. Dir "" is
+// the root.
+func under(path, dir string) bool {
+	return strings.HasPrefix(path, dir) && (len(path) == len(dir) || path[len(dir)] == '/')
+}
+
+func anyUnder(path string, dirs []string) bool {
+	for _, d := range dirs {
+		if under(path, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a may read path.
+func (a *acl) mayRead(path string) bool {
+	if a == nil {
+		return true
+	}
+	return !isSecret(path) && (anyUnder(path, a.read) || anyUnder(path, a.write))
+}
+
+// Reports whether a may write path, and everything under it.
+func (a *acl) mayWrite(path string) bool {
+	return a == nil || anyUnder(path, a.write)
+}
+
+// Reports whether a may see that path exists: whether it may read path,
+// or something under it. So a principal can find its way down to its
+// subtrees, but see nothing else along the way.
+func (a *acl) maySee(path string) bool {
+	if a.mayRead(path) {
+		return true
+	}
+	if isSecret(path) {
+		return false
+	}
+	p := strings.TrimRight(path, "/")
+	for _, dirs := range [][]string{a.read, a.write} {
+		for _, d := range dirs {
+			if under(d, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the entries of directory dir that a may see.
+func (a *acl) filterDir(dir string, ents []string) []string {
+	if a == nil {
+		return ents
+	}
+	dir = strings.TrimRight(dir, "/")
+	var vis []string
+	for _, e := range ents {
+		if a.maySee(dir + "/" + e) {
+			vis = append(vis, e)
+		}
+	}
+	return vis
+}
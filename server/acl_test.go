@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"testing"
+)
+
+func TestUnder(t *testing.T) {
+	assert.T(t, under("/a", "/a"))
+	assert.T(t, under("/a/b", "/a"))
+	assert.T(t, !under("/ab", "/a"))
+	assert.T(t, !under("/", "/a"))
+	assert.T(t, under("/", ""))
+	assert.T(t, under("/a", ""))
+}
+
+func TestACLPaths(t *testing.T) {
+	exp := []string{"/a", "", "/b/c"}
+	assert.Equal(t, exp, aclPaths("/a\n/\n\n bad\n/b/c/\n"))
+}
+
+func TestACLNil(t *testing.T) {
+	var a *acl
+	assert.T(t, a.mayRead("/x"))
+	assert.T(t, a.mayWrite("/x"))
+	assert.T(t, a.maySee("/x"))
+	assert.Equal(t, []string{"x"}, a.filterDir("/", []string{"x"}))
+}
+
+func TestACL(t *testing.T) {
+	a := &acl{read: []string{"/pub"}, write: []string{"/team/a"}}
+
+	assert.T(t, a.mayRead("/pub/x"))
+	assert.T(t, !a.mayWrite("/pub/x"))
+	assert.T(t, a.mayRead("/team/a/x"))
+	assert.T(t, a.mayWrite("/team/a/x"))
+	assert.T(t, a.mayWrite("/team/a"))
+	assert.T(t, !a.mayRead("/team/b/x"))
+	assert.T(t, !a.mayRead("/team"))
+
+	assert.T(t, a.maySee("/"))
+	assert.T(t, a.maySee("/team"))
+	assert.T(t, a.maySee("/team/a/x"))
+	assert.T(t, !a.maySee("/team/b"))
+	assert.T(t, !a.maySee("/ctl"))
+
+	ents := a.filterDir("/", []string{"ctl", "pub", "team"})
+	assert.Equal(t, []string{"pub", "team"}, ents)
+	ents = a.filterDir("/team/", []string{"a", "b"})
+	assert.Equal(t, []string{"a"}, ents)
+}
+
+func TestACLSecrets(t *testing.T) {
+	assert.T(t, isSecret("/ctl/acl/a/secret"))
+	assert.T(t, isSecret("/ctl/secret/rw"))
+	assert.T(t, !isSecret("/ctl/secret"))
+	assert.T(t, !isSecret("/ctl/acl/a/read"))
+	assert.T(t, !isSecret("/ctl/acl/secret"))
+	assert.T(t, !isSecret("/app/secret"))
+
+	a := &acl{read: []string{""}}
+	assert.T(t, a.mayRead("/ctl/acl/a/read"))
+	assert.T(t, !a.mayRead("/ctl/acl/a/secret"))
+	assert.T(t, !a.maySee("/ctl/secret/ro"))
+	assert.T(t, a.maySee("/ctl/secret"))
+	assert.Equal(t, []string{"read"}, a.filterDir("/ctl/acl/a", []string{"read", "secret"}))
+
+	// Not even a principal that may write them may read them.
+	a = &acl{write: []string{"/ctl/acl/a/secret"}}
+	assert.T(t, a.mayWrite("/ctl/acl/a/secret"))
+	assert.T(t, !a.mayRead("/ctl/acl/a/secret"))
+	assert.T(t, !a.maySee("/ctl/acl/a/secret"))
+}
+
+func TestGetACL(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/secret", HashSecret("s"), store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/read", "/x\n/y", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/write", "/z", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/b/read", "/", store.Clobber)))
+
+	_, g := st.Snap()
+	a := getACL(g, "a")
+	assert.Equal(t, []string{"/x", "/y"}, a.read)
+	assert.Equal(t, []string{"/z"}, a.write)
+	a = getACL(g, "nobody")
+	assert.T(t, !a.mayRead("/x"))
+	assert.T(t, !a.maySee("/"))
+
+	name, cred := findPrincipal(g, "", "s")
+	assert.Equal(t, "a", name)
+	assert.Equal(t, store.GetString(g, "/ctl/acl/a/secret"), cred)
+	name, _ = findPrincipal(g, "a", "s")
+	assert.Equal(t, "a", name)
+	name, _ = findPrincipal(g, "b", "s")
+	assert.Equal(t, "", name)
+	name, _ = findPrincipal(g, "", "t")
+	assert.Equal(t, "", name)
+	name, _ = findPrincipal(g, "", "") // b has no secret
+	assert.Equal(t, "", name)
+}
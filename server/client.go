@@ -0,0 +1,105 @@
+package server
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"github.com/ha/doozerd/store"
+	"io"
+)
+
+// A Client sends requests to a doozer server, one at a time, for what
+// the doozer client package has no call for: a member joining a cluster
+// uses it to see every change, including each of several made at one
+// rev.
+type Client struct {
+	c   io.ReadWriter
+	tag int32
+}
+
+// An Error is the error a server responded with.
+type Error struct {
+	Code   string
+	Detail string
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Detail
+}
+
+// Returns a Client that speaks to the server at the other end of c.
+func NewClient(c io.ReadWriter) *Client {
+	return &Client{c: c}
+}
+
+func (cl *Client) call(req *request) (*response, error) {
+	cl.tag++
+	req.Tag = proto.Int32(cl.tag)
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(cl.c, binary.BigEndian, int32(len(buf)))
+	if err != nil {
+		return nil, err
+	}
+	_, err = cl.c.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int32
+	err = binary.Read(cl.c, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	buf = make([]byte, size)
+	_, err = io.ReadFull(cl.c, buf)
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	err = proto.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrCode != nil {
+		return nil, &Error{resp.GetErrCode().String(), resp.GetErrDetail()}
+	}
+	return &resp, nil
+}
+
+// Access gives the server the secret sk, with ACCESS.
+func (cl *Client) Access(sk string) error {
+	_, err := cl.call(&request{
+		Verb:  request_ACCESS.Enum(),
+		Value: []byte(sk),
+	})
+	return err
+}
+
+// Wait returns the first change to a file matching glob on or after rev,
+// passing over the first offset of those made at rev itself; see WAIT in
+// doc/proto.md. The event's Seqn is the rev of the change.
+func (cl *Client) Wait(glob string, rev int64, offset int32) (ev store.Event, err error) {
+	resp, err := cl.call(&request{
+		Verb:   request_WAIT.Enum(),
+		Path:   &glob,
+		Rev:    &rev,
+		Offset: &offset,
+	})
+	if err != nil {
+		return ev, err
+	}
+
+	ev.Seqn = resp.GetRev()
+	ev.Path = resp.GetPath()
+	ev.Body = string(resp.Value)
+	ev.Rev = ev.Seqn
+	if resp.GetFlags()&del != 0 {
+		ev.Rev = store.Missing
+	}
+	return ev, nil
+}
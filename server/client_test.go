@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"net"
+	"testing"
+)
+
+func TestClientWait(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	mut, err := store.EncodeMulti(
+		store.MustEncodeSet("/a", "1", store.Clobber),
+		store.MustEncodeSet("/b", "2", store.Clobber),
+	)
+	assert.Equal(t, nil, err)
+	p.Propose([]byte(mut))
+	p.Propose([]byte(store.MustEncodeDel("/a", store.Clobber)))
+
+	sc, cc := net.Pipe()
+	go serve(sc, st, p, true, "rw", "ro", true, "", Limits{})
+	defer cc.Close()
+
+	cl := NewClient(cc)
+	assert.Equal(t, nil, cl.Access("ro"))
+
+	ev, err := cl.Wait("/*", 1, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), ev.Seqn)
+	assert.Equal(t, "/a", ev.Path)
+	assert.Equal(t, "1", ev.Body)
+	assert.T(t, ev.IsSet())
+
+	ev, err = cl.Wait("/*", 1, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), ev.Seqn)
+	assert.Equal(t, "/b", ev.Path)
+
+	ev, err = cl.Wait("/*", 1, 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2), ev.Seqn)
+	assert.Equal(t, "/a", ev.Path)
+	assert.T(t, ev.IsDel())
+
+	_, err = cl.Wait("/*", 1, -1)
+	assert.Equal(t, &Error{"RANGE", ""}, err)
+
+	assert.NotEqual(t, nil, cl.Access("wrong"))
+}
@@ -19,12 +19,49 @@ type conn struct {
 	canWrite bool
 	rwsk     string
 	rosk     string
+	plain    bool // whether ACCESS is allowed without TLS
 	waccess  bool
 	raccess  bool
 	self     string
+	lim      Limits
+
+	// the principal the client acts as, if any, and its hashed secret
+	// as it was when the client gave the secret ("" if the principal
+	// comes from the client's certificate); see acl.go
+	al        sync.Mutex // guards principal, cred, sfile and scred
+	principal string
+	cred      string
+
+	// if the client doesn't act as a principal, the file that may keep
+	// the server secret its access comes from (rwFile or roFile, or ""
+	// if it has none), and what the file held when the client gave it
+	sfile string
+	scred string
+
+	// the names in the client's verified TLS certificate, if any, and
+	// whether they, rather than a secret, decide the principal
+	certNames []string
+	byCert    bool
+	overTLS   bool
+
+	nonce []byte // from the last CHALLENGE, until it is answered
+
+	// the session, if any, once it has been recorded in the store; see
+	// (*txn).session
+	sl        sync.Mutex // guards sid, stoken, stimeout and sdeadline
+	sid       string
+	stoken    string // what the client must give to resume it
+	stimeout  int64
+	sdeadline int64
+
+	tl     sync.Mutex     // tag lock
+	tags   map[int32]*txn // outstanding requests, by tag
+	closed bool
 }
 
 func (c *conn) serve() {
+	defer c.close()
+
 	for {
 		var t txn
 		t.c = c
@@ -35,10 +72,83 @@ func (c *conn) serve() {
 			}
 			return
 		}
+		if !c.begin(&t) {
+			t.respondErrCode(response_TAG_IN_USE)
+			continue
+		}
 		t.run()
 	}
 }
 
+// Records t as outstanding until it sends its final response.
+// It returns false if another outstanding request has the same tag.
+func (c *conn) begin(t *txn) bool {
+	c.tl.Lock()
+	defer c.tl.Unlock()
+
+	tag := t.req.GetTag()
+	if c.tags[tag] != nil {
+		return false
+	}
+	if c.tags == nil {
+		c.tags = map[int32]*txn{}
+	}
+	t.abort = make(chan bool)
+	t.fin = make(chan bool)
+	c.tags[tag] = t
+	return true
+}
+
+// Forgets t, freeing its tag. It reports whether t was outstanding,
+// and whether the connection is still open.
+func (c *conn) end(t *txn) (held, open bool) {
+	c.tl.Lock()
+	defer c.tl.Unlock()
+
+	tag := t.req.GetTag()
+	if c.tags[tag] == t {
+		delete(c.tags, tag)
+		held = true
+	}
+	return held, !c.closed
+}
+
+// Asks the outstanding request with the given tag, if there is one,
+// to stop, and returns it.
+func (c *conn) cancel(tag int32) *txn {
+	c.tl.Lock()
+	defer c.tl.Unlock()
+
+	t := c.tags[tag]
+	if t != nil && !t.aborted {
+		t.aborted = true
+		close(t.abort)
+	}
+	return t
+}
+
+// Marks c closed and stops every outstanding request, so that their
+// waits and watches on the store are released.
+func (c *conn) close() {
+	c.tl.Lock()
+	defer c.tl.Unlock()
+
+	c.closed = true
+	for _, t := range c.tags {
+		if !t.aborted {
+			t.aborted = true
+			close(t.abort)
+		}
+	}
+}
+
+// Returns the id of c's session, or "" if it has none.
+func (c *conn) session() string {
+	c.sl.Lock()
+	defer c.sl.Unlock()
+	return c.sid
+}
+
 func (c *conn) read(r *request) error {
 	var size int32
 	err := binary.Read(c.c, binary.BigEndian, &size)
@@ -73,18 +183,130 @@ func (c *conn) write(r *response) error {
 	return err
 }
 
-// Grant compares sk against c.rwsk and c.rosk and
-// updates c.waccess and c.raccess as necessary.
+// Grant compares sk against the server's read-write and read-only
+// secrets and updates c.waccess and c.raccess as necessary.
 // It returns true if sk matched either password.
 func (c *conn) grant(sk string) bool {
-	switch sk {
-	case c.rwsk:
-		c.waccess = true
-		c.raccess = true
-		return true
-	case c.rosk:
-		c.raccess = true
-		return true
+	_, g := c.st.Snap()
+	for _, file := range []string{rwFile, roFile} {
+		if c.isServerSecret(g, file, sk) {
+			c.grantServer(g, file)
+			return true
+		}
 	}
 	return false
 }
+
+// Returns the server secret that file would take the place of.
+func (c *conn) envSecret(file string) string {
+	if file == rwFile {
+		return c.rwsk
+	}
+	return c.rosk
+}
+
+// Reports whether sk is the server secret hashed in file, in g, or, if
+// file is empty, the one c was started with.
+func (c *conn) isServerSecret(g store.Getter, file, sk string) bool {
+	if cred := serverCred(g, file); cred != "" {
+		return checkSecret(cred, sk)
+	}
+	return secretsEqual(sk, c.envSecret(file))
+}
+
+// Returns the stored key of the server secret hashed in file, in g, or,
+// if file is empty, of the one c was started with, which has no salt. If
+// file holds something else, it returns nil.
+func (c *conn) serverKey(g store.Getter, file string) []byte {
+	if cred := serverCred(g, file); cred != "" {
+		_, key, _ := parseHashed(cred)
+		return key
+	}
+	return storedKey(clientKey(nil, c.envSecret(file)))
+}
+
+// Gives c the access of the server secret that file, in g, may keep.
+func (c *conn) grantServer(g store.Getter, file string) {
+	c.raccess = true
+	if file == rwFile {
+		c.waccess = true
+	}
+	c.al.Lock()
+	defer c.al.Unlock()
+	c.principal, c.cred = "", ""
+	c.sfile, c.scred = file, serverCred(g, file)
+}
+
+func (c *conn) setPrincipal(name, cred string) {
+	c.al.Lock()
+	defer c.al.Unlock()
+	c.principal, c.cred = name, cred
+	c.sfile, c.scred = "", ""
+}
+
+// Reports whether principal name, in g, still accepts what c gave to act
+// as it: the secret hashed in cred or, if cred is "", c's certificate.
+func (c *conn) holds(g store.Getter, name, cred string) bool {
+	if cred == "" {
+		return certMatches(g, name, c.certNames)
+	}
+	return store.GetString(g, aclDir+"/"+name+"/secret") == cred
+}
+
+// Returns the ACL for c's principal, as the store is now. If c doesn't
+// act as a principal, it returns nil if c has the server's read-write
+// access, or readOnly if not. If the principal no longer accepts the
+// secret or certificate the client gave, the ACL allows nothing.
+func (c *conn) rights() *acl {
+	c.al.Lock()
+	name, cred := c.principal, c.cred
+	c.al.Unlock()
+
+	if name == "" {
+		if c.waccess {
+			return nil
+		}
+		return readOnly
+	}
+	_, g := c.st.Snap()
+	if !c.holds(g, name, cred) {
+		return &acl{}
+	}
+	return getACL(g, name)
+}
+
+// Brings c's access up to date with the store. If c's principal no
+// longer accepts the secret or certificate the client gave, or the server
+// secret c's access comes from has changed, recheck drops it, leaving c
+// with the access of a client that has given no secret. A client whose
+// certificate decides its principal gets whichever principal now names
+// it, if any.
+func (c *conn) recheck() {
+	c.al.Lock()
+	name, cred, sfile, scred := c.principal, c.cred, c.sfile, c.scred
+	c.al.Unlock()
+
+	if name == "" && sfile == "" && !c.byCert {
+		return
+	}
+	_, g := c.st.Snap()
+	if name != "" && c.holds(g, name, cred) {
+		return
+	}
+
+	if c.byCert {
+		if p := findCertPrincipal(g, c.certNames); p != "" {
+			if p != name {
+				c.setPrincipal(p, "")
+				c.raccess, c.waccess = true, true
+			}
+			return
+		}
+	}
+	if name == "" && (sfile == "" || serverCred(g, sfile) == scred) {
+		return
+	}
+	c.setPrincipal("", "")
+	c.raccess, c.waccess = false, false
+	c.grant("")
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
 	"github.com/kr/pretty"
 	"testing"
 )
@@ -33,9 +35,61 @@ var grantTests = []grantTest{
 
 func TestConnGrant(t *testing.T) {
 	for _, tst := range grantTests {
+		tst.c.st = store.New()
 		ok := tst.c.grant(tst.sk)
+		close(tst.c.st.Ops)
 		assert.Equalf(t, tst.ok, ok, "%# v", pretty.Formatter(tst))
 		assert.Equalf(t, tst.r, tst.c.raccess, "%# v", pretty.Formatter(tst))
 		assert.Equalf(t, tst.w, tst.c.waccess, "%# v", pretty.Formatter(tst))
 	}
 }
+
+func TestConnGrantKept(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet(rwFile, HashSecret("b2"), store.Clobber)))
+
+	// The read-write secret kept in the store takes over from the one
+	// the server was started with; the read-only one doesn't change.
+	c := &conn{rosk: "a", rwsk: "b", st: st}
+	assert.T(t, !c.grant("b"))
+	assert.T(t, c.grant("a"))
+	assert.T(t, !c.waccess)
+	assert.T(t, c.grant("b2"))
+	assert.T(t, c.waccess)
+	assert.Equal(t, rwFile, c.sfile)
+
+	// A client whose secret is replaced loses its access.
+	p.Propose([]byte(store.MustEncodeSet(rwFile, HashSecret("b3"), store.Clobber)))
+	c.recheck()
+	assert.T(t, !c.raccess)
+	assert.T(t, !c.waccess)
+	assert.T(t, c.grant("b3"))
+	assert.T(t, c.waccess)
+
+	// Removing it brings back the one the server was started with.
+	p.Propose([]byte(store.MustEncodeDel(rwFile, store.Clobber)))
+	c.recheck()
+	assert.T(t, !c.waccess)
+	assert.T(t, c.grant("b"))
+	assert.T(t, c.waccess)
+}
+
+func TestConnGrantKeptBlank(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+
+	// A client that gave no secret to a server started without one
+	// loses its access once the store keeps one.
+	c := &conn{st: st}
+	assert.T(t, c.grant(""))
+	assert.T(t, c.waccess)
+	p.Propose([]byte(store.MustEncodeSet(rwFile, HashSecret("b"), store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet(roFile, HashSecret("a"), store.Clobber)))
+	c.recheck()
+	assert.T(t, !c.raccess)
+	assert.T(t, !c.waccess)
+	assert.T(t, SecretsKept(st))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/ha/doozerd/store"
+	"strings"
+)
+
+// Limits on what clients can store through one server. A limit of zero
+// means no limit.
+//
+// Unlike the quotas under store.QuotaDir, which are checked as each change
+// is applied, these are checked before a change is proposed, against the
+// store as this server sees it, so they need not be the same for every
+// server in a cluster.
+type Limits struct {
+	Value int64 // bytes in the body of a file
+	Depth int   // names in a path
+	Keys  int64 // files in the store, not counting those in /ctl
+	Bytes int64 // bytes in the store, as counted by store.Getter.Usage
+}
+
+// Returns an error if setting the files in the SET and SEQSET requests in
+// ops, in g, would go over one of l's limits, along with the index of the
+// request that would. Other requests are ignored. A SEQSET request always
+// creates a file, whose path is its prefix with a number appended. As for
+// quotas, the store may go over Keys or Bytes only by getting smaller.
+func (l Limits) check(g store.Getter, ops []*request) (int, error) {
+	keys0, bytes0 := g.Usage("/")
+	keys, bytes := keys0, bytes0
+	for i, op := range ops {
+		if v := op.GetVerb(); v != request_SET && v != request_SEQSET {
+			continue
+		}
+
+		path, n := op.GetPath(), int64(len(op.Value))
+		if l.Value > 0 && n > l.Value {
+			return i, &store.LimitError{path, "value", l.Value}
+		}
+
+		if l.Depth > 0 && strings.Count(path, "/") > l.Depth {
+			return i, &store.LimitError{path, "depth", int64(l.Depth)}
+		}
+
+		if op.GetVerb() == request_SEQSET {
+			path = store.SeqPath(path, 0)
+		}
+		if path == "/ctl" || strings.HasPrefix(path, "/ctl/") {
+			continue
+		}
+
+		// A new file also adds the names in its path. This counts the
+		// whole path, which overstates it if some of them exist already.
+		if k, b := g.Usage(path); k == 0 {
+			keys++
+			bytes += n + int64(len(path))
+		} else {
+			bytes += n - b
+		}
+
+		if l.Keys > 0 && keys > l.Keys && keys > keys0 {
+			return i, &store.LimitError{"/", "keys", l.Keys}
+		}
+
+		if l.Bytes > 0 && bytes > l.Bytes && bytes > bytes0 {
+			return i, &store.LimitError{"/", "bytes", l.Bytes}
+		}
+	}
+	return 0, nil
+}
@@ -16,17 +16,30 @@ var _ = math.Inf
 type request_Verb int32
 
 const (
-	request_GET    request_Verb = 1
-	request_SET    request_Verb = 2
-	request_DEL    request_Verb = 3
-	request_REV    request_Verb = 5
-	request_WAIT   request_Verb = 6
-	request_NOP    request_Verb = 7
-	request_WALK   request_Verb = 9
-	request_GETDIR request_Verb = 14
-	request_STAT   request_Verb = 16
-	request_SELF   request_Verb = 20
-	request_ACCESS request_Verb = 99
+	request_GET       request_Verb = 1
+	request_SET       request_Verb = 2
+	request_DEL       request_Verb = 3
+	request_REV       request_Verb = 5
+	request_WAIT      request_Verb = 6
+	request_NOP       request_Verb = 7
+	request_WALK      request_Verb = 9
+	request_GETDIR    request_Verb = 14
+	request_STAT      request_Verb = 16
+	request_SELF      request_Verb = 20
+	request_MULTI     request_Verb = 21
+	request_DELTREE   request_Verb = 22
+	request_SESSION   request_Verb = 23
+	request_WATCH     request_Verb = 24
+	request_HISTORY   request_Verb = 25
+	request_DIFF      request_Verb = 26
+	request_SEQSET    request_Verb = 27
+	request_LISTDIR   request_Verb = 28
+	request_SCAN      request_Verb = 29
+	request_GETTREE   request_Verb = 30
+	request_CANCEL    request_Verb = 31
+	request_CHALLENGE request_Verb = 32
+	request_ANSWER    request_Verb = 33
+	request_ACCESS    request_Verb = 99
 )
 
 var request_Verb_name = map[int32]string{
@@ -40,20 +53,46 @@ var request_Verb_name = map[int32]string{
 	14: "GETDIR",
 	16: "STAT",
 	20: "SELF",
+	21: "MULTI",
+	22: "DELTREE",
+	23: "SESSION",
+	24: "WATCH",
+	25: "HISTORY",
+	26: "DIFF",
+	27: "SEQSET",
+	28: "LISTDIR",
+	29: "SCAN",
+	30: "GETTREE",
+	31: "CANCEL",
+	32: "CHALLENGE",
+	33: "ANSWER",
 	99: "ACCESS",
 }
 var request_Verb_value = map[string]int32{
-	"GET":    1,
-	"SET":    2,
-	"DEL":    3,
-	"REV":    5,
-	"WAIT":   6,
-	"NOP":    7,
-	"WALK":   9,
-	"GETDIR": 14,
-	"STAT":   16,
-	"SELF":   20,
-	"ACCESS": 99,
+	"GET":       1,
+	"SET":       2,
+	"DEL":       3,
+	"REV":       5,
+	"WAIT":      6,
+	"NOP":       7,
+	"WALK":      9,
+	"GETDIR":    14,
+	"STAT":      16,
+	"SELF":      20,
+	"MULTI":     21,
+	"DELTREE":   22,
+	"SESSION":   23,
+	"WATCH":     24,
+	"HISTORY":   25,
+	"DIFF":      26,
+	"SEQSET":    27,
+	"LISTDIR":   28,
+	"SCAN":      29,
+	"GETTREE":   30,
+	"CANCEL":    31,
+	"CHALLENGE": 32,
+	"ANSWER":    33,
+	"ACCESS":    99,
 }
 
 func (x request_Verb) Enum() *request_Verb {
@@ -88,6 +127,7 @@ const (
 	response_BAD_PATH     response_Err = 6
 	response_MISSING_ARG  response_Err = 7
 	response_RANGE        response_Err = 8
+	response_TOO_BIG      response_Err = 9
 	response_NOTDIR       response_Err = 20
 	response_ISDIR        response_Err = 21
 	response_NOENT        response_Err = 22
@@ -103,6 +143,7 @@ var response_Err_name = map[int32]string{
 	6:   "BAD_PATH",
 	7:   "MISSING_ARG",
 	8:   "RANGE",
+	9:   "TOO_BIG",
 	20:  "NOTDIR",
 	21:  "ISDIR",
 	22:  "NOENT",
@@ -117,6 +158,7 @@ var response_Err_value = map[string]int32{
 	"BAD_PATH":     6,
 	"MISSING_ARG":  7,
 	"RANGE":        8,
+	"TOO_BIG":      9,
 	"NOTDIR":       20,
 	"ISDIR":        21,
 	"NOENT":        22,
@@ -150,6 +192,11 @@ type request struct {
 	OtherTag         *int32        `protobuf:"varint,6,opt,name=other_tag" json:"other_tag,omitempty"`
 	Offset           *int32        `protobuf:"varint,7,opt,name=offset" json:"offset,omitempty"`
 	Rev              *int64        `protobuf:"varint,9,opt,name=rev" json:"rev,omitempty"`
+	Ops              []*request    `protobuf:"bytes,10,rep,name=ops" json:"ops,omitempty"`
+	Ephemeral        *bool         `protobuf:"varint,11,opt,name=ephemeral" json:"ephemeral,omitempty"`
+	Ttl              *int64        `protobuf:"varint,12,opt,name=ttl" json:"ttl,omitempty"`
+	EndRev           *int64        `protobuf:"varint,13,opt,name=end_rev" json:"end_rev,omitempty"`
+	After            *string       `protobuf:"bytes,14,opt,name=after" json:"after,omitempty"`
 	XXX_unrecognized []byte        `json:"-"`
 }
 
@@ -206,6 +253,41 @@ func (this *request) GetRev() int64 {
 	return 0
 }
 
+func (this *request) GetOps() []*request {
+	if this != nil {
+		return this.Ops
+	}
+	return nil
+}
+
+func (this *request) GetEphemeral() bool {
+	if this != nil && this.Ephemeral != nil {
+		return *this.Ephemeral
+	}
+	return false
+}
+
+func (this *request) GetTtl() int64 {
+	if this != nil && this.Ttl != nil {
+		return *this.Ttl
+	}
+	return 0
+}
+
+func (this *request) GetEndRev() int64 {
+	if this != nil && this.EndRev != nil {
+		return *this.EndRev
+	}
+	return 0
+}
+
+func (this *request) GetAfter() string {
+	if this != nil && this.After != nil {
+		return *this.After
+	}
+	return ""
+}
+
 type response struct {
 	Tag              *int32        `protobuf:"varint,1,opt,name=tag" json:"tag,omitempty"`
 	Flags            *int32        `protobuf:"varint,2,opt,name=flags" json:"flags,omitempty"`
@@ -213,6 +295,14 @@ type response struct {
 	Path             *string       `protobuf:"bytes,5,opt,name=path" json:"path,omitempty"`
 	Value            []byte        `protobuf:"bytes,6,opt,name=value" json:"value,omitempty"`
 	Len              *int32        `protobuf:"varint,8,opt,name=len" json:"len,omitempty"`
+	Ttl              *int64        `protobuf:"varint,9,opt,name=ttl" json:"ttl,omitempty"`
+	OldValue         []byte        `protobuf:"bytes,10,opt,name=old_value" json:"old_value,omitempty"`
+	OldRev           *int64        `protobuf:"varint,11,opt,name=old_rev" json:"old_rev,omitempty"`
+	CreatedRev       *int64        `protobuf:"varint,12,opt,name=created_rev" json:"created_rev,omitempty"`
+	ChangedRev       *int64        `protobuf:"varint,13,opt,name=changed_rev" json:"changed_rev,omitempty"`
+	Bytes            *int64        `protobuf:"varint,14,opt,name=bytes" json:"bytes,omitempty"`
+	Files            []*response   `protobuf:"bytes,15,rep,name=files" json:"files,omitempty"`
+	Salt             []byte        `protobuf:"bytes,16,opt,name=salt" json:"salt,omitempty"`
 	ErrCode          *response_Err `protobuf:"varint,100,opt,name=err_code,enum=server.response_Err" json:"err_code,omitempty"`
 	ErrDetail        *string       `protobuf:"bytes,101,opt,name=err_detail" json:"err_detail,omitempty"`
 	XXX_unrecognized []byte        `json:"-"`
@@ -264,6 +354,62 @@ func (this *response) GetLen() int32 {
 	return 0
 }
 
+func (this *response) GetTtl() int64 {
+	if this != nil && this.Ttl != nil {
+		return *this.Ttl
+	}
+	return 0
+}
+
+func (this *response) GetOldValue() []byte {
+	if this != nil {
+		return this.OldValue
+	}
+	return nil
+}
+
+func (this *response) GetOldRev() int64 {
+	if this != nil && this.OldRev != nil {
+		return *this.OldRev
+	}
+	return 0
+}
+
+func (this *response) GetCreatedRev() int64 {
+	if this != nil && this.CreatedRev != nil {
+		return *this.CreatedRev
+	}
+	return 0
+}
+
+func (this *response) GetChangedRev() int64 {
+	if this != nil && this.ChangedRev != nil {
+		return *this.ChangedRev
+	}
+	return 0
+}
+
+func (this *response) GetBytes() int64 {
+	if this != nil && this.Bytes != nil {
+		return *this.Bytes
+	}
+	return 0
+}
+
+func (this *response) GetFiles() []*response {
+	if this != nil {
+		return this.Files
+	}
+	return nil
+}
+
+func (this *response) GetSalt() []byte {
+	if this != nil {
+		return this.Salt
+	}
+	return nil
+}
+
 func (this *response) GetErrCode() response_Err {
 	if this != nil && this.ErrCode != nil {
 		return *this.ErrCode
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// Secrets kept in the store are hashed, in the form
+// "sha256:<salt>:<key>", both hex-encoded. As in SCRAM (RFC 5802), key is
+// the stored key: the SHA-256 of the client key, which is the HMAC-SHA256
+// of "Client Key", keyed with the SHA-256 of the salt followed by the
+// secret. Only a client that knows the secret can work out the client key
+// and so answer a CHALLENGE; the stored key is not enough.
+const hashPrefix = "sha256:"
+
+// HashSecret returns sk hashed with a new random salt, in the form
+// checkSecret accepts.
+func HashSecret(sk string) string {
+	salt := randBytes(16)
+	return hashPrefix + hex.EncodeToString(salt) + ":" + hex.EncodeToString(storedKey(clientKey(salt, sk)))
+}
+
+// Returns the client key for secret sk hashed with salt. The server's own
+// secrets have no salt.
+func clientKey(salt []byte, sk string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(sk))
+	return hmacSum(h.Sum(nil), []byte("Client Key"))
+}
+
+func storedKey(ck []byte) []byte {
+	sum := sha256.Sum256(ck)
+	return sum[:]
+}
+
+func hmacSum(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// Returns the salt and stored key in hashed, in the form HashSecret
+// returns, apart from surrounding space. It returns false if hashed isn't
+// in that form.
+func parseHashed(hashed string) (salt, key []byte, ok bool) {
+	hashed = strings.TrimSpace(hashed)
+	if !strings.HasPrefix(hashed, hashPrefix) {
+		return nil, nil, false
+	}
+	parts := strings.Split(hashed[len(hashPrefix):], ":")
+	if len(parts) != 2 {
+		return nil, nil, false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, false
+	}
+	key, err = hex.DecodeString(parts[1])
+	if err != nil || len(key) != sha256.Size {
+		return nil, nil, false
+	}
+	return salt, key, true
+}
+
+// Reports whether sk is the secret hashed in hashed. Anything not in the
+// form HashSecret returns, apart from surrounding space, matches nothing.
+func checkSecret(hashed, sk string) bool {
+	salt, key, ok := parseHashed(hashed)
+	return ok && subtle.ConstantTimeCompare(storedKey(clientKey(salt, sk)), key) == 1
+}
+
+// Returns the answer to a CHALLENGE with nonce, from a client whose
+// secret has client key ck: ck XORed with the HMAC-SHA256 of the nonce,
+// keyed with the stored key.
+func answerFor(ck, nonce []byte) []byte {
+	return xorBytes(ck, hmacSum(storedKey(ck), nonce))
+}
+
+// Reports whether answer is the answer to a CHALLENGE with nonce, for the
+// secret whose stored key is key. The server recovers the client key from
+// answer, and checks that it hashes to key.
+func checkAnswer(key, nonce, answer []byte) bool {
+	if len(answer) != sha256.Size {
+		return false
+	}
+	ck := xorBytes(answer, hmacSum(key, nonce))
+	return subtle.ConstantTimeCompare(storedKey(ck), key) == 1
+}
+
+func xorBytes(a, b []byte) []byte {
+	x := make([]byte, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+// Used to make up salts for principals that don't exist, so CHALLENGE
+// doesn't tell which do.
+var fakeSaltKey = randBytes(32)
+
+// Returns the salt that principal name's secret is hashed with, as cred
+// holds it, or a made-up one, always the same for name, if there is none.
+func saltFor(name, cred string) []byte {
+	if salt, _, ok := parseHashed(cred); ok {
+		return salt
+	}
+	return hmacSum(fakeSaltKey, []byte(name))[:16]
+}
+
+// Returns n random bytes.
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Reports whether a and b are the same, taking time that depends on
+// neither. They are hashed first so that not even their lengths show.
+func secretsEqual(a, b string) bool {
+	x, y := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(x[:], y[:]) == 1
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+)
+
+func TestHashSecret(t *testing.T) {
+	h := HashSecret("abc")
+	assert.T(t, strings.HasPrefix(h, "sha256:"))
+	assert.T(t, checkSecret(h, "abc"))
+	assert.T(t, checkSecret(h+"\n", "abc"))
+	assert.T(t, !checkSecret(h, "abd"))
+	assert.T(t, !checkSecret(h, ""))
+	assert.Tf(t, h != HashSecret("abc"), "same salt twice")
+}
+
+func TestCheckSecretMalformed(t *testing.T) {
+	for _, h := range []string{"", "abc", "sha256:", "sha256:zz:00", "sha256:00:zz", "sha256:00:00:00"} {
+		assert.Tf(t, !checkSecret(h, "abc"), "%q", h)
+		assert.Tf(t, !checkSecret(h, ""), "%q", h)
+	}
+}
+
+func TestCheckAnswer(t *testing.T) {
+	h := HashSecret("abc")
+	salt, key, _ := parseHashed(h)
+	nonce := randBytes(32)
+	assert.T(t, checkAnswer(key, nonce, answerFor(clientKey(salt, "abc"), nonce)))
+	assert.T(t, !checkAnswer(key, nonce, answerFor(clientKey(salt, "abd"), nonce)))
+	assert.T(t, !checkAnswer(key, randBytes(32), answerFor(clientKey(salt, "abc"), nonce)))
+	assert.T(t, !checkAnswer(key, nonce, nil))
+
+	// The stored key can't stand in for the client key.
+	assert.T(t, !checkAnswer(key, nonce, answerFor(key, nonce)))
+}
+
+func TestSecretsEqual(t *testing.T) {
+	assert.T(t, secretsEqual("", ""))
+	assert.T(t, secretsEqual("abc", "abc"))
+	assert.T(t, !secretsEqual("abc", "abcd"))
+	assert.T(t, !secretsEqual("abc", ""))
+}
+
+func TestSaltFor(t *testing.T) {
+	h := HashSecret("abc")
+	salt, _, ok := parseHashed(h)
+	assert.T(t, ok)
+	assert.Equal(t, salt, saltFor("a", h))
+
+	// Made-up salts look like real ones and don't change.
+	assert.Equal(t, 16, len(saltFor("nobody", "")))
+	assert.Equal(t, saltFor("nobody", ""), saltFor("nobody", ""))
+	assert.Tf(t, string(saltFor("nobody", "")) != string(saltFor("other", "")), "same salt")
+}
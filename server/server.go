@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"github.com/ha/doozerd/consensus"
 	"github.com/ha/doozerd/store"
 	"log"
@@ -9,8 +10,10 @@ import (
 )
 
 // ListenAndServe listens on l, accepts network connections, and
-// handles requests according to the doozer protocol.
-func ListenAndServe(l net.Listener, canWrite chan bool, st *store.Store, p consensus.Proposer, rwsk, rosk string, self string) {
+// handles requests according to the doozer protocol. If plainAccess is
+// false, clients not connected with TLS may not send a secret in the
+// clear with ACCESS; they must use CHALLENGE and ANSWER.
+func ListenAndServe(l net.Listener, canWrite chan bool, st *store.Store, p consensus.Proposer, rwsk, rosk string, plainAccess bool, self string, lim Limits) {
 	var w bool
 	for {
 		c, err := l.Accept()
@@ -32,11 +35,11 @@ func ListenAndServe(l net.Listener, canWrite chan bool, st *store.Store, p conse
 		default:
 		}
 
-		go serve(c, st, p, w, rwsk, rosk, self)
+		go serve(c, st, p, w, rwsk, rosk, plainAccess, self, lim)
 	}
 }
 
-func serve(nc net.Conn, st *store.Store, p consensus.Proposer, w bool, rwsk, rosk string, self string) {
+func serve(nc net.Conn, st *store.Store, p consensus.Proposer, w bool, rwsk, rosk string, plainAccess bool, self string, lim Limits) {
 	c := &conn{
 		c:        nc,
 		addr:     nc.RemoteAddr().String(),
@@ -45,10 +48,28 @@ func serve(nc net.Conn, st *store.Store, p consensus.Proposer, w bool, rwsk, ros
 		canWrite: w,
 		rwsk:     rwsk,
 		rosk:     rosk,
+		plain:    plainAccess,
 		self:     self,
+		lim:      lim,
 	}
 
 	c.grant("") // start as if the client supplied a blank password
+
+	// A client with a verified certificate acts as the principal it names.
+	if tc, ok := nc.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			log.Println(c.addr, err)
+			nc.Close()
+			return
+		}
+		c.overTLS = true
+		if cs := tc.ConnectionState(); len(cs.VerifiedChains) > 0 {
+			c.certNames = certNames(cs.PeerCertificates[0])
+			c.byCert = true
+			c.recheck()
+		}
+	}
+
 	c.serve()
 	nc.Close()
 }
@@ -3,9 +3,23 @@ package server
 import (
 	"bytes"
 	"code.google.com/p/goprotobuf/proto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/session"
 	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
 	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"testing"
 )
@@ -75,13 +89,23 @@ func TestServerNoAccess(t *testing.T) {
 		canWrite: true,
 		st:       store.New(),
 	}
-	tx := &txn{
-		c:   c,
-		req: request{Tag: proto.Int32(1)},
+
+	// These need no access.
+	open := map[int32]bool{
+		int32(request_ACCESS):    true,
+		int32(request_ANSWER):    true,
+		int32(request_CANCEL):    true,
+		int32(request_CHALLENGE): true,
+		int32(request_REV):       true,
+		int32(request_SELF):      true,
 	}
 
 	for i, op := range ops {
-		if i != int32(request_ACCESS) {
+		if !open[i] {
+			tx := &txn{
+				c:   c,
+				req: request{Tag: proto.Int32(1)},
+			}
 			op(tx)
 			var exp response_Err = response_OTHER
 			assert.Equal(t, 4, len(<-b), request_Verb_name[i])
@@ -102,7 +126,7 @@ func TestServerRo(t *testing.T) {
 		req: request{Tag: proto.Int32(1)},
 	}
 
-	wops := []int32{int32(request_DEL), int32(request_NOP), int32(request_SET)}
+	wops := []int32{int32(request_DEL), int32(request_NOP), int32(request_SET), int32(request_MULTI), int32(request_DELTREE), int32(request_SESSION)}
 
 	for _, i := range wops {
 		op := ops[i]
@@ -112,3 +136,1431 @@ func TestServerRo(t *testing.T) {
 		assert.Equal(t, &exp, mustUnmarshal(<-b).ErrCode, request_Verb_name[i])
 	}
 }
+
+func TestMultiNilFields(t *testing.T) {
+	c := &conn{
+		c:        &bytes.Buffer{},
+		canWrite: true,
+		waccess:  true,
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag: proto.Int32(1),
+			Ops: []*request{
+				{Verb: request_SET.Enum(), Path: &fooPath, Rev: proto.Int64(0)},
+				{Verb: request_DEL.Enum(), Path: &fooPath},
+			},
+		},
+	}
+	tx.multi()
+	assertResponseErrCode(t, response_MISSING_ARG, c)
+	r := mustUnmarshal(c.c.(*bytes.Buffer).Bytes()[4:])
+	assert.Equal(t, "1", r.GetErrDetail())
+}
+
+func TestMultiRevMismatch(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/running/x", "other", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag: proto.Int32(1),
+			Ops: []*request{
+				{Verb: request_DEL.Enum(), Path: proto.String("/queue/x"), Rev: proto.Int64(store.Clobber)},
+				{Verb: request_SET.Enum(), Path: proto.String("/running/x"), Value: []byte("job"), Rev: proto.Int64(store.Missing)},
+			},
+		},
+	}
+	tx.multi()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_REV_MISMATCH, r.GetErrCode())
+	assert.Equal(t, "1", r.GetErrDetail())
+	assert.Equal(t, "/running/x", r.GetPath())
+}
+
+func TestMultiRoundTrip(t *testing.T) {
+	exp := &request{
+		Tag:  proto.Int32(1),
+		Verb: request_MULTI.Enum(),
+		Ops: []*request{
+			{Verb: request_SET.Enum(), Path: &fooPath, Value: []byte("a"), Rev: proto.Int64(0)},
+		},
+	}
+	buf, err := proto.Marshal(exp)
+	assert.Equal(t, nil, err)
+
+	got := new(request)
+	assert.Equal(t, nil, proto.Unmarshal(buf, got))
+	assert.Equal(t, 1, len(got.GetOps()))
+	assert.Equal(t, "a", string(got.GetOps()[0].GetValue()))
+}
+
+func TestDeltree(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x/a", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x/b/c", "c", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag:  proto.Int32(1),
+			Path: proto.String("/x"),
+			Rev:  proto.Int64(store.Clobber),
+		},
+	}
+	tx.deltree()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, int64(3), r.GetRev())
+	_, rev := st.Get("/x/a")
+	assert.Equal(t, store.Missing, rev)
+	_, rev = st.Get("/x/b/c")
+	assert.Equal(t, store.Missing, rev)
+}
+
+func TestSeqset(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag:   proto.Int32(1),
+			Path:  proto.String("/q/job-"),
+			Value: []byte("b"),
+		},
+	}
+	tx.seqset()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, int64(2), r.GetRev())
+	assert.Equal(t, "/q/job-0000000002", r.GetPath())
+	v, rev := st.Get("/q/job-0000000002")
+	assert.Equal(t, []string{"b"}, v)
+	assert.Equal(t, int64(2), rev)
+}
+
+func TestSession(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+	}
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Ephemeral: proto.Bool(true)}}
+	tx.set()
+	<-b
+	assert.Equal(t, response_MISSING_ARG, mustUnmarshal(<-b).GetErrCode())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Offset: proto.Int32(60000)}}
+	tx.session()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, c.stoken, string(r.GetValue()))
+	assert.T(t, strings.HasPrefix(c.stoken, c.sid+"."))
+	assert.Equal(t, int64(1), r.GetRev())
+	assert.Equal(t, int64(60e9), c.stimeout)
+
+	// A heartbeat this early doesn't go through consensus.
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1)}}
+	tx.session()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, c.stoken, string(r.GetValue()))
+	assert.Equal(t, (*int64)(nil), r.Rev)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Value: []byte("a"), Ephemeral: proto.Bool(true)}}
+	tx.set()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	_, rev := st.Get("/ctl/session/" + c.sid + "/key/2f666f6f")
+	assert.Equal(t, r.GetRev(), rev)
+}
+
+func TestSessionResumeMissing(t *testing.T) {
+	c := &conn{
+		c:        &bytes.Buffer{},
+		canWrite: true,
+		waccess:  true,
+		st:       store.New(),
+	}
+	defer close(c.st.Ops)
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Offset: proto.Int32(1000), Value: []byte("nope")}}
+	tx.session()
+	assertResponseErrCode(t, response_NOENT, c)
+	assert.Equal(t, "", c.sid)
+}
+
+func TestSessionResumeNeedsToken(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+
+	b := make(bchan, 2)
+	newConn := func() *conn {
+		return &conn{c: b, canWrite: true, waccess: true, st: st, p: p}
+	}
+	start := func(c *conn, value []byte) *response {
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Offset: proto.Int32(60000), Value: value}}
+		tx.session()
+		<-b
+		return mustUnmarshal(<-b)
+	}
+
+	owner := newConn()
+	token := start(owner, nil).GetValue()
+	id := owner.session()
+	assert.NotEqual(t, "", id)
+
+	// Another connection that only knows the id, as anyone who can read
+	// /ctl/session does, can't take the session over.
+	thief := newConn()
+	for _, v := range []string{id, id + ".", id + ".00", store.GetString(st, session.Dir+"/"+id+"/token")} {
+		assert.Equalf(t, response_NOENT, start(thief, []byte(v)).GetErrCode(), "%q", v)
+		assert.Equal(t, "", thief.session())
+	}
+
+	// The owner can resume it on a new connection, with the token.
+	again := newConn()
+	r := start(again, token)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, string(token), string(r.GetValue()))
+	assert.Equal(t, id, again.session())
+}
+
+type failProposer struct{}
+
+func (failProposer) Propose(v []byte) store.Event {
+	return store.Event{Mut: string(v), Err: store.ErrTooLate}
+}
+
+func TestSessionRenewFails(t *testing.T) {
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       store.New(),
+		p:        failProposer{},
+	}
+	defer close(c.st.Ops)
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Offset: proto.Int32(60000)}}
+	tx.session()
+	<-b
+	assert.Equal(t, response_TOO_LATE, mustUnmarshal(<-b).GetErrCode())
+	assert.Equal(t, "", c.session())
+
+	// No ephemeral file can belong to a session that was never recorded.
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Ephemeral: proto.Bool(true)}}
+	tx.set()
+	<-b
+	assert.Equal(t, response_MISSING_ARG, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestSetTtl(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		raccess:  true,
+		st:       st,
+		p:        p,
+	}
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Ttl: proto.Int64(0)}}
+	tx.set()
+	<-b
+	assert.Equal(t, response_RANGE, mustUnmarshal(<-b).GetErrCode())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Value: []byte("a"), Ttl: proto.Int64(60000)}}
+	tx.set()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, int64(1), r.GetRev())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath}}
+	tx.stat()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int64(1), r.GetRev())
+	assert.T(t, r.Ttl != nil && *r.Ttl > 0 && *r.Ttl <= 60000, r.Ttl)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: &fooPath, Rev: proto.Int64(0), Value: []byte("b"), Ttl: proto.Int64(60000)}}
+	tx.set()
+	<-b
+	assert.Equal(t, response_REV_MISMATCH, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestStatDir(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x/a", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x/b", "bb", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x/a", "aaa", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{c: b, raccess: true, st: st}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x")}}
+	tx.stat()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, store.Dir, r.GetRev())
+	assert.Equal(t, int32(2), r.GetLen())
+	assert.Equal(t, int64(1), r.GetCreatedRev())
+	assert.Equal(t, int64(2), r.GetChangedRev())
+	assert.Equal(t, int64(7), r.GetBytes())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x/a")}}
+	tx.stat()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, (*int64)(nil), r.CreatedRev)
+}
+
+func TestSetOverLimit(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        &test.FakeProposer{Store: st},
+		lim:      Limits{Value: 3},
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag:   proto.Int32(1),
+			Verb:  request_SET.Enum(),
+			Path:  proto.String("/x"),
+			Value: []byte("abcd"),
+			Rev:   proto.Int64(store.Clobber),
+		},
+	}
+	tx.set()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_TOO_BIG, r.GetErrCode())
+	assert.Equal(t, (&store.LimitError{"/x", "value", 3}).Error(), r.GetErrDetail())
+}
+
+func TestMultiOverLimit(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        &test.FakeProposer{Store: st},
+		lim:      Limits{Keys: 1},
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag: proto.Int32(1),
+			Ops: []*request{
+				{Verb: request_SET.Enum(), Path: proto.String("/a"), Value: []byte("a"), Rev: proto.Int64(store.Clobber)},
+				{Verb: request_SET.Enum(), Path: proto.String("/b"), Value: []byte("b"), Rev: proto.Int64(store.Clobber)},
+			},
+		},
+	}
+	tx.multi()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_TOO_BIG, r.GetErrCode())
+	assert.Equal(t, "/b", r.GetPath())
+}
+
+func TestSeqsetOverLimit(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/a/x", "1", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+		lim:      Limits{Keys: 1},
+	}
+
+	// The prefix names a directory that exists, but the file doesn't.
+	for _, path := range []string{"/a", "/a/x", "/b"} {
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Verb: request_SEQSET.Enum(), Path: proto.String(path), Value: []byte("v")}}
+		tx.seqset()
+		<-b
+		r := mustUnmarshal(<-b)
+		assert.Equalf(t, response_TOO_BIG, r.GetErrCode(), "%s", path)
+	}
+}
+
+func TestSetOverQuota(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/ctl/quota/q/path", "/app", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/quota/q/bytes", "5", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:        b,
+		canWrite: true,
+		waccess:  true,
+		st:       st,
+		p:        p,
+	}
+	tx := &txn{
+		c: c,
+		req: request{
+			Tag:   proto.Int32(1),
+			Verb:  request_SET.Enum(),
+			Path:  proto.String("/app/x"),
+			Value: []byte("abcdef"),
+			Rev:   proto.Int64(store.Clobber),
+		},
+	}
+	tx.set()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_TOO_BIG, r.GetErrCode())
+	_, rev := st.Get("/app/x")
+	assert.Equal(t, store.Missing, rev)
+}
+
+func TestWatch(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/y", "b", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+		p:       p,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	tx.watch()
+
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, int32(1), r.GetTag())
+	assert.Equal(t, "/x", r.GetPath())
+	assert.Equal(t, int64(1), r.GetRev())
+	assert.Equal(t, int32(set), r.GetFlags())
+
+	p.Propose([]byte(store.MustEncodeDel("/x", store.Clobber)))
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(1), r.GetTag())
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, int32(del), r.GetFlags())
+}
+
+func TestWatchTooLate(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x", "b", store.Clobber)))
+	st.Clean(1)
+
+	c := &conn{
+		c:       &bytes.Buffer{},
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	tx.watch()
+	assertResponseErrCode(t, response_TOO_LATE, c)
+}
+
+func TestHistory(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/y", "b", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeDel("/x", store.Clobber)))
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1), Offset: proto.Int32(1)}}
+	tx.history()
+
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, "/x", r.GetPath())
+	assert.Equal(t, "a", string(r.GetValue()))
+	assert.Equal(t, int64(1), r.GetRev())
+	assert.Equal(t, int32(set), r.GetFlags())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(2), r.GetRev())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/x"), Rev: proto.Int64(2)}}
+	tx.history()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, int32(del), r.GetFlags())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(0), r.GetRev())
+}
+
+func TestListdir(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/d/a", "", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/d/b", "", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/d/c/x", "", store.Clobber)))
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d"), Offset: proto.Int32(2)}}
+	tx.listdir()
+	<-b
+	assert.Equal(t, "a", mustUnmarshal(<-b).GetPath())
+	<-b
+	assert.Equal(t, "b", mustUnmarshal(<-b).GetPath())
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, "b", r.GetPath())
+
+	// Entries added since don't show up in the same rev.
+	p.Propose([]byte(store.MustEncodeSet("/d/bb", "", store.Clobber)))
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d"), Rev: proto.Int64(3), After: proto.String("b")}}
+	tx.listdir()
+	<-b
+	assert.Equal(t, "c", mustUnmarshal(<-b).GetPath())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, (*string)(nil), r.Path)
+}
+
+func TestScan(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/d/a", "1", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/d/b/x", "2", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/d/c", "3", store.Clobber)))
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d/**"), Offset: proto.Int32(2)}}
+	tx.scan()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, "/d/a", r.GetPath())
+	assert.Equal(t, "1", string(r.GetValue()))
+	assert.Equal(t, int64(1), r.GetRev())
+	<-b
+	assert.Equal(t, "/d/b/x", mustUnmarshal(<-b).GetPath())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(3), r.GetRev())
+	assert.Equal(t, "/d/b/x", r.GetPath())
+
+	p.Propose([]byte(store.MustEncodeDel("/d/c", store.Clobber)))
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d/**"), Rev: proto.Int64(3), After: proto.String("/d/b/x"), Offset: proto.Int32(2)}}
+	tx.scan()
+	<-b
+	assert.Equal(t, "/d/c", mustUnmarshal(<-b).GetPath())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, (*string)(nil), r.Path)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d/**"), After: proto.String("d")}}
+	tx.scan()
+	<-b
+	assert.Equal(t, response_BAD_PATH, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestGettree(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/d/a", "1", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/d/b/c", "2", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/e", "3", store.Clobber)))
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/d")}}
+	tx.gettree()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(3), r.GetRev())
+	fs := r.GetFiles()
+	assert.Equal(t, 2, len(fs))
+	assert.Equal(t, "/d/a", fs[0].GetPath())
+	assert.Equal(t, "1", string(fs[0].GetValue()))
+	assert.Equal(t, int64(1), fs[0].GetRev())
+	assert.Equal(t, "/d/b/c", fs[1].GetPath())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/e"), Rev: proto.Int64(3)}}
+	tx.gettree()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, 1, len(r.GetFiles()))
+	assert.Equal(t, "/e", r.GetFiles()[0].GetPath())
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x")}}
+	tx.gettree()
+	<-b
+	assert.Equal(t, response_NOENT, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestGettreeChunks(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	big := make([]byte, treeChunk/2)
+	for i := 0; i < 5; i++ {
+		p.Propose([]byte(store.MustEncodeSet("/d/"+strconv.Itoa(i), string(big), store.Clobber)))
+	}
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/")}}
+	tx.gettree()
+
+	var paths []string
+	for {
+		<-b
+		r := mustUnmarshal(<-b)
+		assert.Equal(t, int32(1), r.GetTag())
+		for _, f := range r.GetFiles() {
+			paths = append(paths, f.GetPath())
+		}
+		if r.GetFlags()&done != 0 {
+			assert.Equal(t, int64(5), r.GetRev())
+			break
+		}
+		assert.Equal(t, 2, len(r.GetFiles()))
+	}
+	assert.Equal(t, []string{"/d/0", "/d/1", "/d/2", "/d/3", "/d/4"}, paths)
+}
+
+func TestHistoryTooLate(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x", "b", store.Clobber)))
+	st.Clean(1)
+
+	b := make(bchan, 2)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	tx.history()
+	<-b
+	assert.Equal(t, response_TOO_LATE, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestDiff(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/config/x", "a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/config/y", "b", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeDel("/config/x", store.Clobber)))
+
+	b := make(bchan, 10)
+	c := &conn{
+		c:       b,
+		raccess: true,
+		st:      st,
+	}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/config/**"), Rev: proto.Int64(1)}}
+	tx.diff()
+
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, "/config/x", r.GetPath())
+	assert.Equal(t, "a", string(r.GetOldValue()))
+	assert.Equal(t, int64(1), r.GetOldRev())
+	assert.Equal(t, int64(0), r.GetRev())
+	assert.Equal(t, int32(del), r.GetFlags())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, "/config/y", r.GetPath())
+	assert.Equal(t, "b", string(r.GetValue()))
+	assert.Equal(t, int64(2), r.GetRev())
+	assert.Equal(t, int32(set), r.GetFlags())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(done), r.GetFlags())
+	assert.Equal(t, int64(3), r.GetRev())
+}
+
+func TestDiffRange(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+
+	c := &conn{raccess: true, st: st}
+	for _, revs := range [][2]int64{{0, 1}, {-1, 1}, {2, 0}, {1, 2}, {1, -1}} {
+		b := make(bchan, 2)
+		c.c = b
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/**"), Rev: proto.Int64(revs[0]), EndRev: proto.Int64(revs[1])}}
+		tx.diff()
+		<-b
+		assert.Equalf(t, response_RANGE, mustUnmarshal(<-b).GetErrCode(), "%v", revs)
+	}
+	assert.Equal(t, 0, <-st.Waiting)
+}
+
+func TestTagInUse(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	b := make(bchan, 2)
+	c := &conn{c: b, raccess: true, st: st}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	assert.T(t, c.begin(tx))
+	tx.wait()
+
+	dup := &txn{c: c, req: request{Tag: proto.Int32(1)}}
+	assert.T(t, !c.begin(dup))
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(2)}}
+	assert.T(t, c.begin(tx))
+	tx.rev()
+	<-b
+	<-b
+	assert.Equal(t, 1, len(c.tags))
+}
+
+func TestCancelWait(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	b := make(bchan, 2)
+	c := &conn{c: b, raccess: true, st: st}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	assert.T(t, c.begin(tx))
+	tx.wait()
+	assert.Equal(t, 1, <-st.Waiting)
+
+	cx := &txn{c: c, req: request{Tag: proto.Int32(2), OtherTag: proto.Int32(1)}}
+	assert.T(t, c.begin(cx))
+	cx.cancel()
+
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, int32(1), r.GetTag())
+	assert.Equal(t, int32(done), r.GetFlags())
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, int32(2), r.GetTag())
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.Equal(t, 0, <-st.Waiting)
+	assert.Equal(t, 0, len(c.tags))
+}
+
+func TestCancelWatch(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{c: b, raccess: true, st: st}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	assert.T(t, c.begin(tx))
+	tx.watch()
+	<-b
+	assert.Equal(t, int64(1), mustUnmarshal(<-b).GetRev())
+
+	cx := &txn{c: c, req: request{Tag: proto.Int32(2), OtherTag: proto.Int32(1)}}
+	assert.T(t, c.begin(cx))
+	cx.cancel()
+
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, int32(1), r.GetTag())
+	assert.Equal(t, int32(done), r.GetFlags())
+	<-b
+	assert.Equal(t, int32(2), mustUnmarshal(<-b).GetTag())
+	assert.Equal(t, 0, <-st.Waiting)
+}
+
+func TestCancelNothing(t *testing.T) {
+	b := &bytes.Buffer{}
+	c := &conn{c: b}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), OtherTag: proto.Int32(5)}}
+	assert.T(t, c.begin(tx))
+	tx.cancel()
+	<-tx.fin
+	assert.T(t, b.Len() > 4)
+	assert.Equal(t, (*response_Err)(nil), mustUnmarshal(b.Bytes()[4:]).ErrCode)
+}
+
+func TestWaitSkip(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/x/a", "", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/x/b", "", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeDeltree("/x", store.Clobber)))
+
+	b := make(bchan, 2)
+	c := &conn{c: b, raccess: true, st: st}
+	for i, exp := range []string{"/x/a", "/x/b"} {
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x/*"), Rev: proto.Int64(3), Offset: proto.Int32(int32(i))}}
+		tx.wait()
+		<-b
+		r := mustUnmarshal(<-b)
+		assert.Equal(t, exp, r.GetPath())
+		assert.Equal(t, int64(3), r.GetRev())
+		assert.Equal(t, int32(del), r.GetFlags())
+	}
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x/*"), Rev: proto.Int64(3), Offset: proto.Int32(-1)}}
+	tx.wait()
+	<-b
+	assert.Equal(t, response_RANGE, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestCloseStopsWaits(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	b := &bytes.Buffer{}
+	c := &conn{c: b, raccess: true, st: st}
+	wt := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(1)}}
+	assert.T(t, c.begin(wt))
+	wt.wait()
+	wa := &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/y"), Rev: proto.Int64(1)}}
+	assert.T(t, c.begin(wa))
+	wa.watch()
+	gt := &txn{c: c, req: request{Tag: proto.Int32(3), Path: proto.String("/x"), Rev: proto.Int64(5)}}
+	assert.T(t, c.begin(gt))
+	gt.get()
+
+	c.close()
+	<-wt.fin
+	<-wa.fin
+	<-gt.fin
+	assert.Equal(t, 0, <-st.Waiting)
+	assert.Equal(t, 0, b.Len())
+}
+
+// Returns a conn acting as principal a, which may read /pub and write
+// /team/a, in a store holding a file in each of /pub, /team/a and
+// /team/b.
+func aclConn(b io.ReadWriter) *conn {
+	st := store.New()
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/secret", HashSecret("sa"), store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/read", "/pub", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/write", "/team/a", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/pub/x", "1", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/team/a/x", "2", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/team/b/x", "3", store.Clobber)))
+
+	c := &conn{c: b, canWrite: true, rwsk: "rw", rosk: "ro", plain: true, st: st, p: p}
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Value: []byte("sa")}}
+	tx.access()
+	return c
+}
+
+func TestACLAccess(t *testing.T) {
+	b := &bytes.Buffer{}
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	assert.Equal(t, (*response_Err)(nil), mustUnmarshal(b.Bytes()[4:]).ErrCode)
+	assert.Equal(t, "a", c.principal)
+
+	// The old secrets still grant access to everything.
+	c.grant("rw")
+	assert.Equal(t, "", c.principal)
+	assert.Equal(t, (*acl)(nil), c.rights())
+}
+
+func TestACLDeny(t *testing.T) {
+	deny := []request{
+		{Verb: request_GET.Enum(), Path: proto.String("/team/b/x")},
+		{Verb: request_STAT.Enum(), Path: proto.String("/team/b/x")},
+		{Verb: request_GETDIR.Enum(), Path: proto.String("/team/b"), Offset: proto.Int32(0)},
+		{Verb: request_LISTDIR.Enum(), Path: proto.String("/ctl")},
+		{Verb: request_GETTREE.Enum(), Path: proto.String("/team/b")},
+		{Verb: request_SET.Enum(), Path: proto.String("/pub/x"), Rev: proto.Int64(store.Clobber)},
+		{Verb: request_DEL.Enum(), Path: proto.String("/team/b/x"), Rev: proto.Int64(store.Clobber)},
+		{Verb: request_DELTREE.Enum(), Path: proto.String("/team"), Rev: proto.Int64(store.Clobber)},
+		{Verb: request_SEQSET.Enum(), Path: proto.String("/team/b/q-")},
+		{Verb: request_SEQSET.Enum(), Path: proto.String("/team/a")},
+	}
+
+	for _, req := range deny {
+		b := &bytes.Buffer{}
+		c := aclConn(b)
+		b.Reset()
+		req.Tag = proto.Int32(2)
+		tx := &txn{c: c, req: req}
+		tx.run()
+		assertResponseErrCode(t, response_OTHER, c)
+		assert.Equalf(t, "permission denied", mustUnmarshal(b.Bytes()[4:]).GetErrDetail(), "%v", req.GetVerb())
+		close(c.st.Ops)
+	}
+}
+
+func TestACLMulti(t *testing.T) {
+	b := make(bchan, 2)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Ops: []*request{
+		{Verb: request_SET.Enum(), Path: proto.String("/team/a/y"), Rev: proto.Int64(store.Clobber)},
+		{Verb: request_SET.Enum(), Path: proto.String("/team/b/y"), Rev: proto.Int64(store.Clobber)},
+	}}}
+	tx.multi()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_OTHER, r.GetErrCode())
+	assert.Equal(t, "/team/b/y", r.GetPath())
+	assert.Equal(t, "1: permission denied", r.GetErrDetail())
+}
+
+func TestACLSeqset(t *testing.T) {
+	b := make(bchan, 4)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/team/a/q-")}}
+	tx.seqset()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, response_Err(0), r.GetErrCode())
+	assert.Equal(t, "/team/a/q-0000000007", r.GetPath())
+
+	// A file named for the prefix of the subtree is not in it.
+	tx = &txn{c: c, req: request{Tag: proto.Int32(3), Path: proto.String("/team/a")}}
+	tx.seqset()
+	<-b
+	r = mustUnmarshal(<-b)
+	assert.Equal(t, response_OTHER, r.GetErrCode())
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+	_, rev := c.st.Get("/team/a0000000008")
+	assert.Equal(t, store.Missing, rev)
+}
+
+func TestACLFilter(t *testing.T) {
+	b := make(bchan, 20)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/")}}
+	tx.listdir()
+	var got []string
+	for {
+		<-b
+		r := mustUnmarshal(<-b)
+		if r.GetFlags()&done != 0 {
+			break
+		}
+		got = append(got, r.GetPath())
+	}
+	assert.Equal(t, []string{"pub", "team"}, got)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/**")}}
+	tx.scan()
+	got = nil
+	for {
+		<-b
+		r := mustUnmarshal(<-b)
+		if r.GetFlags()&done != 0 {
+			break
+		}
+		got = append(got, r.GetPath())
+	}
+	assert.Equal(t, []string{"/pub/x", "/team/a/x"}, got)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/team/*/x"), Offset: proto.Int32(1)}}
+	tx.walk()
+	<-b
+	assert.Equal(t, response_RANGE, mustUnmarshal(<-b).GetErrCode())
+}
+
+func TestACLWait(t *testing.T) {
+	b := make(bchan, 2)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/team/**"), Rev: proto.Int64(7)}}
+	tx.wait()
+	c.p.Propose([]byte(store.MustEncodeSet("/team/b/y", "", store.Clobber)))
+	c.p.Propose([]byte(store.MustEncodeSet("/team/a/y", "", store.Clobber)))
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, "/team/a/y", r.GetPath())
+	assert.Equal(t, int64(8), r.GetRev())
+}
+
+func TestACLWaitSkip(t *testing.T) {
+	b := make(bchan, 2)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	m, _ := store.EncodeMulti(
+		store.MustEncodeSet("/team/a/y", "", store.Clobber),
+		store.MustEncodeSet("/team/b/y", "", store.Clobber),
+		store.MustEncodeSet("/team/a/z", "", store.Clobber),
+	)
+	c.p.Propose([]byte(m))
+
+	// The change it may not read doesn't count.
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Path: proto.String("/team/**"), Rev: proto.Int64(7), Offset: proto.Int32(1)}}
+	tx.wait()
+	<-b
+	r := mustUnmarshal(<-b)
+	assert.Equal(t, "/team/a/z", r.GetPath())
+	assert.Equal(t, int64(7), r.GetRev())
+}
+
+func TestACLRotate(t *testing.T) {
+	b := make(bchan, 2)
+	c := aclConn(b)
+	defer close(c.st.Ops)
+	<-b
+	<-b
+
+	get := &txn{c: c, req: request{Tag: proto.Int32(2), Verb: request_GET.Enum(), Path: proto.String("/pub/x")}}
+	get.run()
+	<-b
+	assert.Equal(t, "1", string(mustUnmarshal(<-b).Value))
+
+	c.p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/secret", HashSecret("new"), store.Clobber)))
+	assert.Equal(t, &acl{}, c.rights())
+
+	get = &txn{c: c, req: request{Tag: proto.Int32(2), Verb: request_GET.Enum(), Path: proto.String("/pub/x")}}
+	get.run()
+	<-b
+	assert.Equal(t, "permission denied", mustUnmarshal(<-b).GetErrDetail())
+	assert.Equal(t, "", c.principal)
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(2), Verb: request_ACCESS.Enum(), Path: proto.String("a"), Value: []byte("new")}}
+	tx.run()
+	<-b
+	assert.Equal(t, (*response_Err)(nil), mustUnmarshal(<-b).ErrCode)
+	assert.Equal(t, "a", c.principal)
+}
+
+// Returns a certificate for cn, signed by parent and parentKey, or
+// self-signed if parent is nil.
+func mustCert(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, key
+}
+
+func TestCertNames(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "a"},
+		DNSNames:       []string{"a.example.com"},
+		EmailAddresses: []string{"a@example.com"},
+	}
+	assert.Equal(t, []string{"a", "a.example.com", "a@example.com"}, certNames(cert))
+}
+
+func TestSecretsHidden(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	cred := HashSecret("s")
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/secret", cred, store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/a/write", "/", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/secret/ro", HashSecret("ro"), store.Clobber)))
+
+	b := make(bchan, 10)
+	ro := &conn{c: b, st: st, raccess: true}
+	prin := &conn{c: b, st: st, raccess: true, waccess: true}
+	prin.setPrincipal("a", cred)
+	rw := &conn{c: b, st: st, raccess: true, waccess: true}
+
+	get := func(c *conn, path string) *response {
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String(path)}}
+		tx.get()
+		<-b
+		return mustUnmarshal(<-b)
+	}
+	tree := func(c *conn) (paths []string) {
+		tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/ctl")}}
+		tx.gettree()
+		<-b
+		for _, f := range mustUnmarshal(<-b).GetFiles() {
+			paths = append(paths, f.GetPath())
+		}
+		return paths
+	}
+
+	for _, c := range []*conn{ro, prin} {
+		assert.Equal(t, "permission denied", get(c, "/ctl/acl/a/secret").GetErrDetail())
+		assert.Equal(t, "permission denied", get(c, "/ctl/secret/ro").GetErrDetail())
+		assert.Equal(t, []string{"/ctl/acl/a/write"}, tree(c))
+
+		for i, exp := range []string{"write", ""} {
+			tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("/ctl/acl/a"), Offset: proto.Int32(int32(i))}}
+			tx.getdir()
+			<-b
+			assert.Equal(t, exp, mustUnmarshal(<-b).GetPath())
+		}
+	}
+
+	assert.Equal(t, cred, string(get(rw, "/ctl/acl/a/secret").Value))
+	assert.Equal(t, []string{"/ctl/acl/a/secret", "/ctl/acl/a/write", "/ctl/secret/ro"}, tree(rw))
+}
+
+func TestServeClientCert(t *testing.T) {
+	_, ca, caKey := mustCert("ca", nil, nil)
+	srv, _, _ := mustCert("server", ca, caKey)
+	cli, _, _ := mustCert("billing", ca, caKey)
+
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/b/cert", "billing\n", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/b/write", "/billing", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/billing/x", "1", store.Clobber)))
+	p.Propose([]byte(store.MustEncodeSet("/other/x", "2", store.Clobber)))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	sc, cc := net.Pipe()
+	sc = tls.Server(sc, &tls.Config{
+		Certificates: []tls.Certificate{srv},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	cc = tls.Client(cc, &tls.Config{
+		Certificates:       []tls.Certificate{cli},
+		InsecureSkipVerify: true,
+	})
+	go serve(sc, st, p, true, "rw", "ro", true, "", Limits{})
+	defer cc.Close()
+
+	call := func(req *request) *response {
+		buf, err := proto.Marshal(req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, nil, binary.Write(cc, binary.BigEndian, int32(len(buf))))
+		_, err = cc.Write(buf)
+		assert.Equal(t, nil, err)
+
+		var size int32
+		assert.Equal(t, nil, binary.Read(cc, binary.BigEndian, &size))
+		buf = make([]byte, size)
+		_, err = io.ReadFull(cc, buf)
+		assert.Equal(t, nil, err)
+		return mustUnmarshal(buf)
+	}
+
+	r := call(&request{Tag: proto.Int32(1), Verb: request_GET.Enum(), Path: proto.String("/billing/x")})
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.Equal(t, "1", string(r.Value))
+
+	r = call(&request{Tag: proto.Int32(1), Verb: request_GET.Enum(), Path: proto.String("/other/x")})
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+
+	// Unmapping the certificate takes away its access.
+	p.Propose([]byte(store.MustEncodeDel("/ctl/acl/b/cert", store.Clobber)))
+	r = call(&request{Tag: proto.Int32(1), Verb: request_GET.Enum(), Path: proto.String("/billing/x")})
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+}
+
+func TestRecheckCert(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &test.FakeProposer{Store: st}
+
+	c := &conn{st: st, rwsk: "rw", rosk: "ro", plain: true, certNames: []string{"svc"}, byCert: true}
+	c.recheck()
+	assert.Equal(t, "", c.principal)
+	assert.T(t, !c.raccess)
+
+	p.Propose([]byte(store.MustEncodeSet("/ctl/acl/x/cert", "other\nsvc", store.Clobber)))
+	c.recheck()
+	assert.Equal(t, "x", c.principal)
+	assert.T(t, c.raccess)
+
+	// A secret given with ACCESS takes over from the certificate.
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Value: []byte("ro")}}
+	c.c = &bytes.Buffer{}
+	tx.access()
+	assert.Equal(t, "", c.principal)
+	assert.T(t, !c.byCert)
+	c.recheck()
+	assert.Equal(t, "", c.principal)
+}
+
+// Sends a CHALLENGE for name, then an ANSWER computed with sk, on c, and
+// returns the response to the ANSWER.
+func challengeAnswer(c *conn, name, sk string) *response {
+	b := &bytes.Buffer{}
+	c.c = b
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String(name)}}
+	tx.challenge()
+	r := mustUnmarshal(b.Bytes()[4:])
+
+	b.Reset()
+	v := answerFor(clientKey(r.Salt, sk), r.Value)
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String(name), Value: v}}
+	tx.answer()
+	return mustUnmarshal(b.Bytes()[4:])
+}
+
+func TestChallengeServerSecret(t *testing.T) {
+	c := &conn{rwsk: "rw", rosk: "ro", st: store.New()}
+	defer close(c.st.Ops)
+
+	r := challengeAnswer(c, "", "nope")
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+	assert.T(t, !c.raccess)
+
+	r = challengeAnswer(c, "", "ro")
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.T(t, c.raccess)
+	assert.T(t, !c.waccess)
+
+	r = challengeAnswer(c, "", "rw")
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.T(t, c.waccess)
+}
+
+func TestChallengeKeptSecret(t *testing.T) {
+	c := &conn{rwsk: "rw", rosk: "ro", st: store.New()}
+	defer close(c.st.Ops)
+	p := &test.FakeProposer{Store: c.st}
+	p.Propose([]byte(store.MustEncodeSet(rwFile, HashSecret("rw2"), store.Clobber)))
+
+	// The secret the server was started with no longer works.
+	r := challengeAnswer(c, "", "rw")
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+	r = challengeAnswer(c, rwFile, "rw")
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+	assert.T(t, !c.waccess)
+
+	r = challengeAnswer(c, rwFile, "rw2")
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.T(t, c.waccess)
+
+	// The read-only secret is still the one the server was started with.
+	c.raccess, c.waccess = false, false
+	r = challengeAnswer(c, "", "ro")
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.T(t, c.raccess)
+	assert.T(t, !c.waccess)
+}
+
+func TestChallengePrincipal(t *testing.T) {
+	c := aclConn(&bytes.Buffer{})
+	defer close(c.st.Ops)
+	c.setPrincipal("", "")
+
+	r := challengeAnswer(c, "a", "wrong")
+	assert.Equal(t, "permission denied", r.GetErrDetail())
+	assert.Equal(t, "", c.principal)
+
+	r = challengeAnswer(c, "a", "sa")
+	assert.Equal(t, (*response_Err)(nil), r.ErrCode)
+	assert.Equal(t, "a", c.principal)
+	assert.Equal(t, store.GetString(c.st, "/ctl/acl/a/secret"), c.cred)
+}
+
+func TestChallengeStoredKey(t *testing.T) {
+	c := aclConn(&bytes.Buffer{})
+	defer close(c.st.Ops)
+	c.setPrincipal("", "")
+
+	// Knowing the hashed secret is not enough to answer.
+	_, key, _ := parseHashed(store.GetString(c.st, "/ctl/acl/a/secret"))
+	b := &bytes.Buffer{}
+	c.c = b
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("a")}}
+	tx.challenge()
+	nonce := mustUnmarshal(b.Bytes()[4:]).Value
+	b.Reset()
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Path: proto.String("a"), Value: hmacSum(key, nonce)}}
+	tx.answer()
+	assert.Equal(t, "permission denied", mustUnmarshal(b.Bytes()[4:]).GetErrDetail())
+	assert.Equal(t, "", c.principal)
+}
+
+func TestAnswerOnce(t *testing.T) {
+	c := &conn{rwsk: "rw", rosk: "ro", st: store.New()}
+	defer close(c.st.Ops)
+	b := &bytes.Buffer{}
+	c.c = b
+
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1)}}
+	tx.challenge()
+	nonce := mustUnmarshal(b.Bytes()[4:]).Value
+	assert.Equal(t, 32, len(nonce))
+	v := answerFor(clientKey(nil, "rw"), nonce)
+
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Value: v}}
+	tx.answer()
+	assert.T(t, c.waccess)
+
+	// A captured answer can't be replayed.
+	c.raccess, c.waccess = false, false
+	b.Reset()
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Value: v}}
+	tx.answer()
+	assert.Equal(t, "permission denied", mustUnmarshal(b.Bytes()[4:]).GetErrDetail())
+	assert.T(t, !c.waccess)
+}
+
+func TestPlainAccessDisabled(t *testing.T) {
+	b := &bytes.Buffer{}
+	c := &conn{c: b, rwsk: "rw", st: store.New()}
+	defer close(c.st.Ops)
+	tx := &txn{c: c, req: request{Tag: proto.Int32(1), Value: []byte("rw")}}
+	tx.access()
+	assertResponseErrCode(t, response_OTHER, c)
+	assert.Equal(t, errPlainAccess.Error(), mustUnmarshal(b.Bytes()[4:]).GetErrDetail())
+	assert.T(t, !c.waccess)
+
+	// The secret isn't in the clear over TLS.
+	b.Reset()
+	c.overTLS = true
+	tx = &txn{c: c, req: request{Tag: proto.Int32(1), Value: []byte("rw")}}
+	tx.access()
+	assert.T(t, c.waccess)
+}
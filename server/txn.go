@@ -2,43 +2,73 @@ package server
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"errors"
 	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/session"
 	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/ttl"
 	"io"
 	"log"
 	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type txn struct {
 	c    *conn
 	req  request
 	resp response
+
+	// see (*conn).begin and (*conn).cancel
+	abort   chan bool // closed to ask t to stop
+	aborted bool
+	fin     chan bool // closed once t has sent its last response
 }
 
 var ops = map[int32]func(*txn){
-	int32(request_DEL):    (*txn).del,
-	int32(request_GET):    (*txn).get,
-	int32(request_GETDIR): (*txn).getdir,
-	int32(request_NOP):    (*txn).nop,
-	int32(request_REV):    (*txn).rev,
-	int32(request_SET):    (*txn).set,
-	int32(request_STAT):   (*txn).stat,
-	int32(request_SELF):   (*txn).self,
-	int32(request_WAIT):   (*txn).wait,
-	int32(request_WALK):   (*txn).walk,
-	int32(request_ACCESS): (*txn).access,
+	int32(request_DEL):       (*txn).del,
+	int32(request_GET):       (*txn).get,
+	int32(request_GETDIR):    (*txn).getdir,
+	int32(request_NOP):       (*txn).nop,
+	int32(request_REV):       (*txn).rev,
+	int32(request_SET):       (*txn).set,
+	int32(request_STAT):      (*txn).stat,
+	int32(request_SELF):      (*txn).self,
+	int32(request_WAIT):      (*txn).wait,
+	int32(request_WALK):      (*txn).walk,
+	int32(request_MULTI):     (*txn).multi,
+	int32(request_DELTREE):   (*txn).deltree,
+	int32(request_SESSION):   (*txn).session,
+	int32(request_WATCH):     (*txn).watch,
+	int32(request_HISTORY):   (*txn).history,
+	int32(request_DIFF):      (*txn).diff,
+	int32(request_SEQSET):    (*txn).seqset,
+	int32(request_LISTDIR):   (*txn).listdir,
+	int32(request_SCAN):      (*txn).scan,
+	int32(request_GETTREE):   (*txn).gettree,
+	int32(request_CANCEL):    (*txn).cancel,
+	int32(request_CHALLENGE): (*txn).challenge,
+	int32(request_ANSWER):    (*txn).answer,
+	int32(request_ACCESS):    (*txn).access,
 }
 
 // response flags
 const (
 	_ = 1 << iota
-	_
+	done
 	set
 	del
 )
 
+// Returned by getter when the request is cancelled while it waits.
+var errCanceled = errors.New("canceled")
+
+var errPlainAccess = errors.New("ACCESS is disabled without TLS; use CHALLENGE and ANSWER")
+
 func (t *txn) run() {
+	t.c.recheck()
 	verb := int32(t.req.GetVerb())
 	if f, ok := ops[verb]; ok {
 		f(t)
@@ -58,6 +88,11 @@ func (t *txn) get() {
 		return
 	}
 
+	if !t.c.rights().mayRead(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
 	go func() {
 		g, err := t.getter()
 		if err != nil {
@@ -95,8 +130,55 @@ func (t *txn) set() {
 		return
 	}
 
+	sid := t.c.session()
+	if t.req.GetEphemeral() && sid == "" {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	if t.req.Ttl != nil && *t.req.Ttl <= 0 {
+		t.respondErrCode(response_RANGE)
+		return
+	}
+
+	if !t.c.rights().mayWrite(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	set, err := store.EncodeSet(*t.req.Path, string(t.req.Value), *t.req.Rev)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	_, g := t.c.st.Snap()
+	if _, err := t.c.lim.check(g, []*request{&t.req}); err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	// Anything else about the file must be written in the same change,
+	// so that it gets the same rev.
+	muts := []string{set}
+	if t.req.GetEphemeral() {
+		muts = append(muts, session.Key(sid, *t.req.Path))
+	}
+	if t.req.Ttl != nil {
+		deadline := time.Now().UnixNano() + *t.req.Ttl*1e6
+		muts = append(muts, ttl.Key(*t.req.Path, deadline))
+	}
+
 	go func() {
-		ev := consensus.Set(t.c.p, *t.req.Path, t.req.Value, *t.req.Rev)
+		var ev store.Event
+		if len(muts) == 1 {
+			ev = consensus.Set(t.c.p, *t.req.Path, t.req.Value, *t.req.Rev)
+		} else {
+			ev = consensus.Multi(t.c.p, muts)
+			if err, ok := ev.Err.(*store.MultiError); ok {
+				ev.Err = err.Err
+			}
+		}
 		if ev.Err != nil {
 			t.respondOsError(ev.Err)
 			return
@@ -122,6 +204,11 @@ func (t *txn) del() {
 		return
 	}
 
+	if !t.c.rights().mayWrite(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
 	go func() {
 		ev := consensus.Del(t.c.p, *t.req.Path, *t.req.Rev)
 		if ev.Err != nil {
@@ -132,6 +219,226 @@ func (t *txn) del() {
 	}()
 }
 
+func (t *txn) deltree() {
+	if !t.c.waccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if !t.c.canWrite {
+		t.respondErrCode(response_READONLY)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Rev == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	if !t.c.rights().mayWrite(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	go func() {
+		ev := consensus.Deltree(t.c.p, *t.req.Path, *t.req.Rev)
+		if ev.Err != nil {
+			t.respondOsError(ev.Err)
+			return
+		}
+		t.resp.Rev = &ev.Seqn
+		t.respond()
+	}()
+}
+
+func (t *txn) seqset() {
+	if !t.c.waccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if !t.c.canWrite {
+		t.respondErrCode(response_READONLY)
+		return
+	}
+
+	if t.req.Path == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	// The prefix is only the start of the name of the file to be created;
+	// "/a" makes "/a0000000007", in "/", not in "/a".
+	if !t.c.rights().mayWrite(store.SeqPath(*t.req.Path, 0)) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	_, g := t.c.st.Snap()
+	if _, err := t.c.lim.check(g, []*request{&t.req}); err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	go func() {
+		ev := consensus.Seq(t.c.p, *t.req.Path, t.req.Value)
+		if ev.Err != nil {
+			t.respondOsError(ev.Err)
+			return
+		}
+		t.resp.Path = &ev.Path
+		t.resp.Rev = &ev.Seqn
+		t.respond()
+	}()
+}
+
+func (t *txn) session() {
+	if !t.c.waccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if !t.c.canWrite {
+		t.respondErrCode(response_READONLY)
+		return
+	}
+
+	c := t.c
+	now := time.Now().UnixNano()
+	c.sl.Lock()
+	id, token, timeout := c.sid, c.stoken, c.stimeout
+	start := false
+	switch {
+	case t.req.Offset != nil: // a new session, or one to resume
+		if *t.req.Offset <= 0 {
+			c.sl.Unlock()
+			t.respondErrCode(response_RANGE)
+			return
+		}
+
+		if t.req.Value != nil {
+			// Only the token of a session can resume it.
+			token = string(t.req.Value)
+			if id = session.Find(c.st, token); id == "" {
+				c.sl.Unlock()
+				t.respondErrCode(response_NOENT)
+				return
+			}
+		} else {
+			id, token = session.NewToken()
+			start = true
+		}
+		timeout = int64(*t.req.Offset) * 1e6
+	case c.sid == "":
+		c.sl.Unlock()
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	case now >= c.sdeadline:
+		c.sid = ""
+		c.sl.Unlock()
+		t.respondErrCode(response_NOENT)
+		return
+	case c.sdeadline-now > c.stimeout/2:
+		// Not worth a trip through consensus yet.
+		c.sl.Unlock()
+		t.resp.Value = []byte(token)
+		t.respond()
+		return
+	}
+	c.sl.Unlock()
+
+	deadline := now + timeout
+	t.resp.Value = []byte(token)
+	go func() {
+		var ev store.Event
+		if start {
+			ev = session.Start(c.p, id, token, timeout, deadline)
+		} else {
+			ev = session.Renew(c.p, id, timeout, deadline)
+		}
+		if ev.Err != nil {
+			t.respondOsError(ev.Err)
+			return
+		}
+
+		// Only now is the session in the store, for ephemeral files to
+		// belong to.
+		c.sl.Lock()
+		if id != c.sid || deadline > c.sdeadline {
+			c.sid, c.stoken, c.stimeout, c.sdeadline = id, token, timeout, deadline
+		}
+		c.sl.Unlock()
+		t.resp.Rev = &ev.Seqn
+		t.respond()
+	}()
+}
+
+func (t *txn) multi() {
+	if !t.c.waccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if !t.c.canWrite {
+		t.respondErrCode(response_READONLY)
+		return
+	}
+
+	if len(t.req.Ops) == 0 {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	a := t.c.rights()
+	muts := make([]string, len(t.req.Ops))
+	for i, op := range t.req.Ops {
+		if op.Path == nil || op.Rev == nil {
+			t.respondOpErrCode(i, op.GetPath(), response_MISSING_ARG)
+			return
+		}
+
+		if !a.mayWrite(*op.Path) {
+			t.respondOpError(i, *op.Path, syscall.EACCES)
+			return
+		}
+
+		var err error
+		switch op.GetVerb() {
+		case request_SET:
+			muts[i], err = store.EncodeSet(*op.Path, string(op.Value), *op.Rev)
+		case request_DEL:
+			muts[i], err = store.EncodeDel(*op.Path, *op.Rev)
+		default:
+			t.respondOpErrCode(i, *op.Path, response_UNKNOWN_VERB)
+			return
+		}
+		if err != nil {
+			t.respondOpError(i, *op.Path, err)
+			return
+		}
+	}
+
+	_, g := t.c.st.Snap()
+	if i, err := t.c.lim.check(g, t.req.Ops); err != nil {
+		t.respondOpError(i, t.req.Ops[i].GetPath(), err)
+		return
+	}
+
+	go func() {
+		ev := consensus.Multi(t.c.p, muts)
+		if err, ok := ev.Err.(*store.MultiError); ok {
+			t.respondOpError(err.Index, err.Path, err.Err)
+			return
+		}
+		if ev.Err != nil {
+			t.respondOsError(ev.Err)
+			return
+		}
+		t.resp.Rev = &ev.Seqn
+		t.respond()
+	}()
+}
+
 func (t *txn) nop() {
 	if !t.c.waccess {
 		t.respondOsError(syscall.EACCES)
@@ -161,7 +468,7 @@ func (t *txn) self() {
 }
 
 func (t *txn) stat() {
-	if !t.c.raccess {
+	if !t.c.raccess || !t.c.rights().mayRead(t.req.GetPath()) {
 		t.respondOsError(syscall.EACCES)
 		return
 	}
@@ -176,10 +483,29 @@ func (t *txn) stat() {
 		len, rev := g.Stat(t.req.GetPath())
 		t.resp.Len = &len
 		t.resp.Rev = &rev
+		if rev == store.Dir {
+			created, changed := g.DirRevs(t.req.GetPath())
+			_, bytes := g.Usage(t.req.GetPath())
+			t.resp.CreatedRev = &created
+			t.resp.ChangedRev = &changed
+			t.resp.Bytes = &bytes
+		}
+		if d := ttl.Deadline(g, t.req.GetPath()); d != 0 {
+			t.resp.Ttl = proto.Int64(remaining(d))
+		}
 		t.respond()
 	}()
 }
 
+// Returns the milliseconds left until deadline, or 0 if it has passed.
+func remaining(deadline int64) int64 {
+	ms := (deadline - time.Now().UnixNano()) / 1e6
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
+
 func (t *txn) getdir() {
 	if !t.c.raccess {
 		t.respondOsError(syscall.EACCES)
@@ -191,6 +517,12 @@ func (t *txn) getdir() {
 		return
 	}
 
+	a := t.c.rights()
+	if !a.maySee(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
 	go func() {
 		g, err := t.getter()
 		if err != nil {
@@ -208,6 +540,7 @@ func (t *txn) getdir() {
 			return
 		}
 
+		ents = a.filterDir(*t.req.Path, ents)
 		sort.Strings(ents)
 		offset := int(*t.req.Offset)
 		if offset < 0 || offset >= len(ents) {
@@ -220,53 +553,98 @@ func (t *txn) getdir() {
 	}()
 }
 
-func (t *txn) wait() {
+// The most entries LISTDIR and SCAN will send for one request, unless
+// asked for fewer.
+const maxBatch = 1000
+
+// Returns how many entries LISTDIR or SCAN should send, or 0 if the
+// request asks for a bad number.
+func (t *txn) batchLimit() int {
+	if t.req.Offset == nil {
+		return maxBatch
+	}
+	if n := int(*t.req.Offset); n > 0 {
+		if n < maxBatch {
+			return n
+		}
+		return maxBatch
+	}
+	return 0
+}
+
+func (t *txn) listdir() {
 	if !t.c.raccess {
 		t.respondOsError(syscall.EACCES)
 		return
 	}
 
-	if t.req.Path == nil || t.req.Rev == nil {
+	if t.req.Path == nil {
 		t.respondErrCode(response_MISSING_ARG)
 		return
 	}
 
-	glob, err := store.CompileGlob(*t.req.Path)
-	if err != nil {
-		t.respondOsError(err)
+	limit := t.batchLimit()
+	if limit == 0 {
+		t.respondErrCode(response_RANGE)
 		return
 	}
 
-	ch, err := t.c.st.Wait(glob, *t.req.Rev)
-	if err != nil {
-		t.respondOsError(err)
+	a := t.c.rights()
+	if !a.maySee(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
 		return
 	}
 
 	go func() {
-		ev := <-ch
-		t.resp.Path = &ev.Path
-		t.resp.Value = []byte(ev.Body)
-		t.resp.Rev = &ev.Seqn
-		switch {
-		case ev.IsSet():
-			t.resp.Flags = proto.Int32(set)
-		case ev.IsDel():
-			t.resp.Flags = proto.Int32(del)
-		default:
-			t.resp.Flags = proto.Int32(0)
+		g, rev, err := t.pinnedGetter()
+		if err != nil {
+			t.respondOsError(err)
+			return
+		}
+
+		ents, r := g.Get(*t.req.Path)
+		if r == store.Missing {
+			t.respondErrCode(response_NOENT)
+			return
+		}
+		if r != store.Dir {
+			t.respondErrCode(response_NOTDIR)
+			return
+		}
+
+		ents = a.filterDir(*t.req.Path, ents)
+		sort.Strings(ents)
+		after := t.req.GetAfter()
+		i := sort.SearchStrings(ents, after)
+		if i < len(ents) && ents[i] == after {
+			i++
+		}
+
+		ents = ents[i:]
+		for i, ent := range ents {
+			if i == limit {
+				t.resp.Path = &ents[i-1]
+				break
+			}
+			r := response{Tag: t.req.Tag, Path: proto.String(ent)}
+			if !t.send(&r) {
+				return
+			}
 		}
+
+		t.resp.Rev = &rev
+		t.resp.Flags = proto.Int32(done)
 		t.respond()
 	}()
 }
 
-func (t *txn) walk() {
+func (t *txn) scan() {
 	if !t.c.raccess {
 		t.respondOsError(syscall.EACCES)
 		return
 	}
 
-	if t.req.Path == nil || t.req.Offset == nil {
+	if t.req.Path == nil {
 		t.respondErrCode(response_MISSING_ARG)
 		return
 	}
@@ -277,61 +655,639 @@ func (t *txn) walk() {
 		return
 	}
 
-	offset := *t.req.Offset
-	if offset < 0 {
+	if t.req.After != nil {
+		if err := store.CheckPath(*t.req.After); err != nil {
+			t.respondOsError(err)
+			return
+		}
+	}
+
+	limit := t.batchLimit()
+	if limit == 0 {
 		t.respondErrCode(response_RANGE)
 		return
 	}
 
+	a := t.c.rights()
 	go func() {
-		g, err := t.getter()
+		g, rev, err := t.pinnedGetter()
 		if err != nil {
 			t.respondOsError(err)
 			return
 		}
 
+		var last string
+		stopped := false
+		n := 0
 		f := func(path, body string, rev int64) (stop bool) {
-			if offset == 0 {
-				t.resp.Path = &path
-				t.resp.Value = []byte(body)
-				t.resp.Rev = &rev
-				t.resp.Flags = proto.Int32(set)
-				t.respond()
+			if !a.mayRead(path) {
+				return false
+			}
+			if n == limit {
+				t.resp.Path = &last
 				return true
 			}
-			offset--
+			r := response{
+				Tag:   t.req.Tag,
+				Path:  &path,
+				Value: []byte(body),
+				Rev:   &rev,
+				Flags: proto.Int32(set),
+			}
+			if !t.send(&r) {
+				stopped = true
+				return true
+			}
+			last = path
+			n++
 			return false
 		}
-		if !store.Walk(g, glob, f) {
-			t.respondErrCode(response_RANGE)
+		if t.req.After != nil {
+			store.WalkAfter(g, glob, *t.req.After, f)
+		} else {
+			store.Walk(g, glob, f)
+		}
+		if stopped {
+			return
 		}
-	}()
-}
+
+		t.resp.Rev = &rev
+		t.resp.Flags = proto.Int32(done)
+		t.respond()
+	}()
+}
+
+// GETTREE sends files in chunks of about this many bytes of paths and
+// values.
+const treeChunk = 64 * 1024
+
+func (t *txn) gettree() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	if err := store.CheckPath(*t.req.Path); err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	pat := strings.TrimRight(*t.req.Path, "/") + "/**"
+	glob, err := store.CompileGlob(pat)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	a := t.c.rights()
+	if !a.maySee(*t.req.Path) {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	go func() {
+		g, rev, err := t.pinnedGetter()
+		if err != nil {
+			t.respondOsError(err)
+			return
+		}
+
+		v, r := g.Get(*t.req.Path)
+		if r == store.Missing {
+			t.respondErrCode(response_NOENT)
+			return
+		}
+
+		var files []*response
+		stopped := false
+		n := 0
+		f := func(path, body string, rev int64) (stop bool) {
+			if !a.mayRead(path) {
+				return false
+			}
+			files = append(files, &response{Path: &path, Value: []byte(body), Rev: &rev})
+			n += len(path) + len(body)
+			if n < treeChunk {
+				return false
+			}
+			r := response{Tag: t.req.Tag, Files: files}
+			files, n = nil, 0
+			stopped = !t.send(&r)
+			return stopped
+		}
+		if r == store.Dir {
+			store.Walk(g, glob, f)
+		} else {
+			f(*t.req.Path, v[0], r)
+		}
+		if stopped {
+			return
+		}
+
+		t.resp.Files = files
+		t.resp.Rev = &rev
+		t.resp.Flags = proto.Int32(done)
+		t.respond()
+	}()
+}
+
+func (t *txn) wait() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Rev == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	skip := int(t.req.GetOffset())
+	if skip < 0 {
+		t.respondErrCode(response_RANGE)
+		return
+	}
+
+	glob, err := store.CompileGlob(*t.req.Path)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	if t.c.rights() != nil {
+		t.waitReadable(glob, skip)
+		return
+	}
+
+	ch, err := t.c.st.WaitSkip(glob, *t.req.Rev, skip)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	go func() {
+		select {
+		case ev := <-ch:
+			setEvent(&t.resp, ev)
+			t.respond()
+		case <-t.abort:
+			t.c.st.Unwait(glob, ch)
+			t.respondCanceled()
+		}
+	}()
+}
+
+// Like wait, but skips changes that t's principal may not read. It has
+// to look at every change, not just the first, so it uses a Watch.
+func (t *txn) waitReadable(glob *store.Glob, skip int) {
+	w, err := t.c.st.Watch(glob, *t.req.Rev)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case ev, ok := <-w.C:
+				if !ok {
+					if w.Err != nil {
+						t.resp.Rev = &w.Rev
+						t.respondOsError(w.Err)
+					} else {
+						t.finish()
+					}
+					return
+				}
+				if !t.c.rights().mayRead(ev.Path) {
+					continue
+				}
+				if ev.Seqn == *t.req.Rev && skip > 0 {
+					skip--
+					continue
+				}
+				setEvent(&t.resp, ev)
+				t.respond()
+				return
+			case <-t.abort:
+				t.respondCanceled()
+				return
+			}
+		}
+	}()
+}
+
+func (t *txn) watch() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Rev == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	glob, err := store.CompileGlob(*t.req.Path)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	w, err := t.c.st.Watch(glob, *t.req.Rev)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	go func() {
+		for {
+			var ev store.Event
+			var ok bool
+			select {
+			case ev, ok = <-w.C:
+			case <-t.abort:
+				w.Stop()
+				t.respondCanceled()
+				return
+			}
+			if !ok {
+				break
+			}
+			if !t.c.rights().mayRead(ev.Path) {
+				continue
+			}
+
+			r := response{Tag: t.req.Tag}
+			setEvent(&r, ev)
+			if !t.send(&r) {
+				w.Stop()
+				return
+			}
+		}
+
+		if w.Err != nil {
+			t.resp.Rev = &w.Rev
+			t.respondOsError(w.Err)
+		} else {
+			t.finish()
+		}
+	}()
+}
+
+// The most events HISTORY will send for one request, unless asked for
+// fewer.
+const maxHistory = 1000
+
+func (t *txn) history() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Rev == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	limit := maxHistory
+	if t.req.Offset != nil {
+		if *t.req.Offset <= 0 {
+			t.respondErrCode(response_RANGE)
+			return
+		}
+		if int(*t.req.Offset) < limit {
+			limit = int(*t.req.Offset)
+		}
+	}
+
+	glob, err := store.CompileGlob(*t.req.Path)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	a := t.c.rights()
+	go func() {
+		evs, next, err := t.c.st.History(glob, *t.req.Rev, t.req.GetEndRev(), limit)
+		if err != nil {
+			t.respondOsError(err)
+			return
+		}
+
+		for _, ev := range evs {
+			if !a.mayRead(ev.Path) {
+				continue
+			}
+			r := response{Tag: t.req.Tag}
+			setEvent(&r, ev)
+			if !t.send(&r) {
+				return
+			}
+		}
+
+		t.resp.Rev = &next
+		t.resp.Flags = proto.Int32(done)
+		t.respond()
+	}()
+}
+
+func (t *txn) diff() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Rev == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	glob, err := store.CompileGlob(*t.req.Path)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	// Both revs must exist already; DIFF doesn't wait for them.
+	cur := <-t.c.st.Seqns
+	end := t.req.GetEndRev()
+	if end == 0 {
+		end = cur
+	}
+	if *t.req.Rev <= 0 || *t.req.Rev > cur || end < 0 || end > cur {
+		t.respondErrCode(response_RANGE)
+		return
+	}
+
+	a := t.c.rights()
+	go func() {
+		ds, err := t.c.st.Diff(glob, *t.req.Rev, end)
+		if err != nil {
+			t.respondOsError(err)
+			return
+		}
+
+		for _, d := range ds {
+			if !a.mayRead(d.Path) {
+				continue
+			}
+			r := response{
+				Tag:      t.req.Tag,
+				Path:     proto.String(d.Path),
+				Value:    []byte(d.NewBody),
+				Rev:      proto.Int64(d.NewRev),
+				OldValue: []byte(d.OldBody),
+				OldRev:   proto.Int64(d.OldRev),
+				Flags:    proto.Int32(set),
+			}
+			if d.NewRev == store.Missing {
+				r.Flags = proto.Int32(del)
+			}
+			if !t.send(&r) {
+				return
+			}
+		}
+
+		t.resp.Rev = &end
+		t.resp.Flags = proto.Int32(done)
+		t.respond()
+	}()
+}
+
+// Fills in r with the details of ev, for WAIT, WATCH and HISTORY.
+func setEvent(r *response, ev store.Event) {
+	r.Path = &ev.Path
+	r.Value = []byte(ev.Body)
+	r.Rev = &ev.Seqn
+	switch {
+	case ev.IsSet():
+		r.Flags = proto.Int32(set)
+	case ev.IsDel():
+		r.Flags = proto.Int32(del)
+	default:
+		r.Flags = proto.Int32(0)
+	}
+}
+
+func (t *txn) walk() {
+	if !t.c.raccess {
+		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	if t.req.Path == nil || t.req.Offset == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	glob, err := store.CompileGlob(*t.req.Path)
+	if err != nil {
+		t.respondOsError(err)
+		return
+	}
+
+	offset := *t.req.Offset
+	if offset < 0 {
+		t.respondErrCode(response_RANGE)
+		return
+	}
+
+	a := t.c.rights()
+	go func() {
+		g, err := t.getter()
+		if err != nil {
+			t.respondOsError(err)
+			return
+		}
+
+		f := func(path, body string, rev int64) (stop bool) {
+			if !a.mayRead(path) {
+				return false
+			}
+			if offset == 0 {
+				t.resp.Path = &path
+				t.resp.Value = []byte(body)
+				t.resp.Rev = &rev
+				t.resp.Flags = proto.Int32(set)
+				t.respond()
+				return true
+			}
+			offset--
+			return false
+		}
+		if !store.Walk(g, glob, f) {
+			t.respondErrCode(response_RANGE)
+		}
+	}()
+}
+
+func (t *txn) cancel() {
+	if t.req.OtherTag == nil {
+		t.respondErrCode(response_MISSING_ARG)
+		return
+	}
+
+	if *t.req.OtherTag == t.req.GetTag() {
+		t.respond() // nothing else to stop
+		return
+	}
+
+	o := t.c.cancel(*t.req.OtherTag)
+	go func() {
+		// Whatever o was going to send has been sent before we respond.
+		if o != nil {
+			<-o.fin
+		}
+		t.respond()
+	}()
+}
 
 func (t *txn) access() {
-	if t.c.grant(string(t.req.Value)) {
+	if !t.c.plain && !t.c.overTLS {
+		t.respondOsError(errPlainAccess)
+		return
+	}
+
+	sk := string(t.req.Value)
+	if t.c.grant(sk) {
+		t.c.byCert = false
 		t.respond()
-	} else {
+		return
+	}
+
+	_, g := t.c.st.Snap()
+	if name, cred := findPrincipal(g, t.req.GetPath(), sk); name != "" {
+		t.c.byCert = false
+		t.c.setPrincipal(name, cred)
+		t.c.raccess = true
+		t.c.waccess = true
+		t.respond()
+		return
+	}
+	t.respondOsError(syscall.EACCES)
+}
+
+func (t *txn) challenge() {
+	t.c.nonce = randBytes(32)
+	_, g := t.c.st.Snap()
+	switch name := t.req.GetPath(); name {
+	case "":
+	case rwFile, roFile:
+		if cred := serverCred(g, name); cred != "" {
+			t.resp.Salt = saltFor(name, cred)
+		}
+	default:
+		t.resp.Salt = saltFor(name, store.GetString(g, aclDir+"/"+name+"/secret"))
+	}
+	t.resp.Value = t.c.nonce
+	t.respond()
+}
+
+func (t *txn) answer() {
+	c := t.c
+	nonce := c.nonce
+	c.nonce = nil // good for one try only
+	if nonce == nil {
 		t.respondOsError(syscall.EACCES)
+		return
+	}
+
+	v := t.req.Value
+	_, g := c.st.Snap()
+	var files []string
+	switch name := t.req.GetPath(); {
+	case name == "":
+		// Those the server was started with, unless the store keeps others.
+		for _, file := range []string{rwFile, roFile} {
+			if serverCred(g, file) == "" {
+				files = append(files, file)
+			}
+		}
+	case name == rwFile || name == roFile:
+		files = []string{name}
+	case !strings.Contains(name, "/"):
+		cred := store.GetString(g, aclDir+"/"+name+"/secret")
+		_, key, ok := parseHashed(cred)
+		if ok && checkAnswer(key, nonce, v) {
+			c.byCert = false
+			c.setPrincipal(name, cred)
+			c.raccess = true
+			c.waccess = true
+			t.respond()
+			return
+		}
+	}
+
+	for _, file := range files {
+		if checkAnswer(c.serverKey(g, file), nonce, v) {
+			c.grantServer(g, file)
+			c.byCert = false
+			t.respond()
+			return
+		}
 	}
+	t.respondOsError(syscall.EACCES)
 }
 
-func (t *txn) respondOsError(err error) {
+func errCode(err error) response_Err {
+	if _, ok := err.(*store.LimitError); ok {
+		return response_TOO_BIG
+	}
+
 	switch err {
 	case store.ErrBadPath:
-		t.respondErrCode(response_BAD_PATH)
+		return response_BAD_PATH
 	case store.ErrRevMismatch:
-		t.respondErrCode(response_REV_MISMATCH)
+		return response_REV_MISMATCH
 	case store.ErrTooLate:
-		t.respondErrCode(response_TOO_LATE)
+		return response_TOO_LATE
+	case store.ErrNoRev:
+		return response_RANGE
 	case syscall.EISDIR:
-		t.respondErrCode(response_ISDIR)
+		return response_ISDIR
 	case syscall.ENOTDIR:
-		t.respondErrCode(response_NOTDIR)
-	default:
+		return response_NOTDIR
+	}
+	return response_OTHER
+}
+
+func (t *txn) respondOsError(err error) {
+	if err == errCanceled {
+		t.respondCanceled()
+		return
+	}
+
+	e := errCode(err)
+	if e == response_OTHER || e == response_TOO_BIG {
 		t.resp.ErrDetail = proto.String(err.Error())
-		t.respondErrCode(response_OTHER)
 	}
+	t.respondErrCode(e)
+}
+
+// Responds to a MULTI request with err, the error from the operation at
+// index i, which refers to path.
+func (t *txn) respondOpError(i int, path string, err error) {
+	e := errCode(err)
+	detail := strconv.Itoa(i)
+	if e == response_OTHER || e == response_TOO_BIG {
+		detail += ": " + err.Error()
+	}
+	t.resp.Path = &path
+	t.resp.ErrDetail = &detail
+	t.respondErrCode(e)
+}
+
+func (t *txn) respondOpErrCode(i int, path string, e response_Err) {
+	t.resp.Path = &path
+	t.resp.ErrDetail = proto.String(strconv.Itoa(i))
+	t.respondErrCode(e)
 }
 
 func (t *txn) respondErrCode(e response_Err) {
@@ -341,12 +1297,60 @@ func (t *txn) respondErrCode(e response_Err) {
 
 func (t *txn) respond() {
 	t.resp.Tag = t.req.Tag
-	err := t.c.write(&t.resp)
-	if err != nil && err != io.EOF {
-		log.Println(err)
+	held, open := t.c.end(t)
+	if open {
+		err := t.c.write(&t.resp)
+		if err != nil && err != io.EOF {
+			log.Println(err)
+		}
+	}
+	if held {
+		close(t.fin)
 	}
 }
 
+// Sends the final response for a request that was cancelled.
+func (t *txn) respondCanceled() {
+	t.resp = response{Flags: proto.Int32(done)}
+	t.respond()
+}
+
+// Like respond, but sends nothing.
+func (t *txn) finish() {
+	if held, _ := t.c.end(t); held {
+		close(t.fin)
+	}
+}
+
+// Sends r, one of several responses to t. If t has been cancelled, or r
+// can't be written, it ends t instead and returns false.
+func (t *txn) send(r *response) bool {
+	select {
+	case <-t.abort:
+		t.respondCanceled()
+		return false
+	default:
+	}
+
+	if err := t.c.write(r); err != nil {
+		t.finish()
+		return false
+	}
+	return true
+}
+
+// Like getter, but also returns the rev the store is at, which is the
+// current rev if the request doesn't give one.
+func (t *txn) pinnedGetter() (store.Getter, int64, error) {
+	if t.req.Rev == nil {
+		rev, g := t.c.st.Snap()
+		return g, rev, nil
+	}
+
+	g, err := t.getter()
+	return g, *t.req.Rev, err
+}
+
 func (t *txn) getter() (store.Getter, error) {
 	if t.req.Rev == nil {
 		_, g := t.c.st.Snap()
@@ -357,5 +1361,12 @@ func (t *txn) getter() (store.Getter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return <-ch, nil
+
+	select {
+	case ev := <-ch:
+		return ev, nil
+	case <-t.abort:
+		t.c.st.Unwait(store.Any, ch)
+		return nil, errCanceled
+	}
 }
@@ -0,0 +1,160 @@
+// Package session keeps track of client sessions and the ephemeral
+// files that belong to them.
+//
+// Each session is a directory in the store, so it is replicated like
+// everything else and outlives the server that created it:
+//
+//	/ctl/session/<id>/timeout   the timeout, in nanoseconds
+//	/ctl/session/<id>/deadline  when the session expires, in Unix nanoseconds
+//	/ctl/session/<id>/token     the SHA-256 of the session's token, in hex
+//	/ctl/session/<id>/key/<x>   the path of an ephemeral file, hex-encoded as x
+//
+// A key is given the same rev as its file. When the session expires,
+// the file is deleted with it, unless the file has changed since.
+//
+// The id of a session is no secret, but its token is: a client must give
+// the token to resume the session, and so own its ephemeral files.
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/member"
+	"github.com/ha/doozerd/store"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Dir = "/ctl/session"
+
+// NewId returns a new, random session id.
+func NewId() string {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewToken returns the id of a new session, and its token: the id and a
+// random secret, joined by a dot.
+func NewToken() (id, token string) {
+	id = NewId()
+	return id, id + "." + NewId()
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Find returns the id of the session in g that token was returned for,
+// with NewToken, or "" if there is no such session.
+func Find(g store.Getter, token string) string {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return ""
+	}
+	id := token[:i]
+	h := store.GetString(g, Dir+"/"+id+"/token")
+	if h == "" || subtle.ConstantTimeCompare([]byte(h), []byte(hashToken(token))) != 1 {
+		return ""
+	}
+	return id
+}
+
+// Exists returns true if g holds the session id.
+func Exists(g store.Getter, id string) bool {
+	_, rev := g.Get(Dir + "/" + id + "/deadline")
+	return rev > 0
+}
+
+// Timeout returns the timeout of session id in g, or 0 if there is no
+// such session.
+func Timeout(g store.Getter, id string) int64 {
+	n, _ := strconv.ParseInt(store.GetString(g, Dir+"/"+id+"/timeout"), 10, 64)
+	return n
+}
+
+// Start proposes a new session, with the id and token returned by
+// NewToken, that expires at deadline.
+func Start(p consensus.Proposer, id, token string, timeout, deadline int64) (e store.Event) {
+	dir := Dir + "/" + id
+	return consensus.Multi(p, []string{
+		store.MustEncodeSet(dir+"/timeout", strconv.FormatInt(timeout, 10), store.Clobber),
+		store.MustEncodeSet(dir+"/deadline", strconv.FormatInt(deadline, 10), store.Clobber),
+		store.MustEncodeSet(dir+"/token", hashToken(token), store.Missing),
+	})
+}
+
+// Renew proposes that session id expire at deadline, creating the
+// session if necessary.
+func Renew(p consensus.Proposer, id string, timeout, deadline int64) (e store.Event) {
+	dir := Dir + "/" + id
+	return consensus.Multi(p, []string{
+		store.MustEncodeSet(dir+"/timeout", strconv.FormatInt(timeout, 10), store.Clobber),
+		store.MustEncodeSet(dir+"/deadline", strconv.FormatInt(deadline, 10), store.Clobber),
+	})
+}
+
+// Key returns a mutation that makes the file at path belong to session
+// id. It must be applied together with the mutation that sets the file,
+// as part of a multi mutation, so the two have the same rev; the file
+// will be deleted when the session expires, unless it changes first.
+func Key(id, path string) string {
+	return store.MustEncodeSet(Dir+"/"+id+"/key/"+hex.EncodeToString([]byte(path)), path, store.Clobber)
+}
+
+// Expire deletes each session whose deadline has passed, along with its
+// ephemeral files, once per tick of ticker, if self is the first CAL;
+// see member.IsFirst.
+func Expire(st *store.Store, p consensus.Proposer, self string, ticker <-chan time.Time) {
+	for t := range ticker {
+		_, g := st.Snap()
+		if !member.IsFirst(g, self) {
+			continue
+		}
+
+		for _, id := range expired(g, t.UnixNano()) {
+			e := consensus.Multi(p, reap(g, id))
+			if e.Err != nil {
+				log.Println(e.Err)
+			}
+		}
+	}
+}
+
+func expired(g store.Getter, now int64) (ids []string) {
+	for _, id := range store.Getdir(g, Dir) {
+		s := store.GetString(g, Dir+"/"+id+"/deadline")
+		deadline, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || deadline < now {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns the mutations that delete session id, as it is in g, along
+// with each of its files that has not changed since it was set.
+func reap(g store.Getter, id string) (muts []string) {
+	glob := store.MustCompileGlob(Dir + "/" + id + "/**")
+	keys := store.MustCompileGlob(Dir + "/" + id + "/key/*")
+	store.Walk(g, glob, func(path, body string, rev int64) bool {
+		if keys.Match(path) {
+			if _, r := g.Get(body); r == rev {
+				muts = append(muts, store.MustEncodeDel(body, rev))
+			}
+		}
+		muts = append(muts, store.MustEncodeDel(path, rev))
+		return false
+	})
+	return muts
+}
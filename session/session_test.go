@@ -0,0 +1,110 @@
+package session
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"testing"
+	"time"
+)
+
+func setEphemeral(p consensus.Proposer, id, path, body string, rev int64) store.Event {
+	return consensus.Multi(p, []string{store.MustEncodeSet(path, body, rev), Key(id, path)})
+}
+
+func TestSessionRenew(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+
+	e := Renew(fp, "a", 5, 10)
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, Exists(st, "a"))
+	assert.Equal(t, int64(5), Timeout(st, "a"))
+	assert.Equal(t, "10", store.GetString(st, "/ctl/session/a/deadline"))
+	assert.T(t, !Exists(st, "b"))
+}
+
+func TestSessionStart(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+
+	id, token := NewToken()
+	e := Start(fp, id, token, 5, 10)
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, Exists(st, id))
+	assert.Equal(t, id, Find(st, token))
+
+	// The id alone, or with another secret, is not enough.
+	assert.Equal(t, "", Find(st, id))
+	assert.Equal(t, "", Find(st, id+"."))
+	assert.Equal(t, "", Find(st, id+"."+NewId()))
+	_, other := NewToken()
+	assert.Equal(t, "", Find(st, other))
+
+	// Renewing keeps the token.
+	e = Renew(fp, id, 5, 20)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, id, Find(st, token))
+}
+
+func TestSessionKey(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+
+	e := setEphemeral(fp, "a", "/x", "1", store.Missing)
+	assert.Equal(t, nil, e.Err)
+	v, rev := st.Get("/x")
+	assert.Equal(t, []string{"1"}, v)
+	v, krev := st.Get("/ctl/session/a/key/2f78")
+	assert.Equal(t, []string{"/x"}, v)
+	assert.Equal(t, rev, krev)
+}
+
+func TestSessionExpire(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/0", "", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/1", "me", store.Clobber)))
+
+	Renew(fp, "a", 5, 10)
+	Renew(fp, "b", 5, 100)
+	setEphemeral(fp, "a", "/x", "1", store.Clobber)
+	setEphemeral(fp, "a", "/y", "1", store.Clobber)
+	setEphemeral(fp, "b", "/z", "1", store.Clobber)
+	fp.Propose([]byte(store.MustEncodeSet("/y", "2", store.Clobber))) // no longer ephemeral
+
+	ticker := make(chan time.Time)
+	go Expire(st, fp, "me", ticker)
+	ticker <- time.Unix(0, 50)
+	ticker <- time.Unix(0, 50) // wait for the first tick to finish
+	close(ticker)
+
+	assert.T(t, !Exists(st, "a"))
+	_, rev := st.Get("/x")
+	assert.Equal(t, store.Missing, rev)
+	assert.Equal(t, "2", store.GetString(st, "/y"))
+	assert.Equal(t, "1", store.GetString(st, "/z"))
+	assert.T(t, Exists(st, "b"))
+}
+
+func TestSessionExpireNotFirst(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/0", "other", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/1", "me", store.Clobber)))
+	Renew(fp, "a", 5, 10)
+
+	ticker := make(chan time.Time)
+	go Expire(st, fp, "me", ticker)
+	ticker <- time.Unix(0, 50)
+	ticker <- time.Unix(0, 50)
+	close(ticker)
+
+	assert.T(t, Exists(st, "a"))
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"strconv"
 	"testing"
 )
 
@@ -43,3 +44,64 @@ func benchmarkNHist(n int, b *testing.B) {
 	b.StopTimer()
 	close(st.Ops)
 }
+
+// Each of n watches is on a different subtree; the event matches none.
+func watchesAndEvent(n int) ([]*watch, Event) {
+	ws := make([]*watch, n)
+	for i := range ws {
+		ws[i] = &watch{
+			glob: MustCompileGlob("/svc/" + strconv.Itoa(i) + "/*"),
+			rev:  1,
+			c:    make(chan Event, 1),
+		}
+	}
+	return ws, Event{Seqn: 1, Path: "/svc/x/foo", Rev: 1}
+}
+
+func benchmarkNotifyLinear(n int, b *testing.B) {
+	b.StopTimer()
+	st := &Store{}
+	ws, ev := watchesAndEvent(n)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ws = st.notify(ev, ws)
+	}
+}
+
+func benchmarkNotifyIndexed(n int, b *testing.B) {
+	b.StopTimer()
+	var x watchIndex
+	ws, ev := watchesAndEvent(n)
+	for _, w := range ws {
+		x.add(w)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		x.notify(ev)
+	}
+}
+
+func BenchmarkNotifyLinear1e3(b *testing.B)  { benchmarkNotifyLinear(1e3, b) }
+func BenchmarkNotifyLinear1e5(b *testing.B)  { benchmarkNotifyLinear(1e5, b) }
+func BenchmarkNotifyIndexed1e3(b *testing.B) { benchmarkNotifyIndexed(1e3, b) }
+func BenchmarkNotifyIndexed1e5(b *testing.B) { benchmarkNotifyIndexed(1e5, b) }
+
+// Mutations applied with n clients each waiting on their own file.
+func benchmarkWatchers(n int, b *testing.B) {
+	b.StopTimer()
+	st := New()
+	for i := 0; i < n; i++ {
+		st.Wait(MustCompileGlob("/svc/"+strconv.Itoa(i)+"/*"), 1)
+	}
+	mut := MustEncodeSet("/svc/x/foo", "12345", Clobber)
+	b.StartTimer()
+	for i := 1; i <= b.N; i++ {
+		st.Ops <- Op{int64(i), mut}
+	}
+	<-st.Seqns
+	b.StopTimer()
+	close(st.Ops)
+}
+
+func BenchmarkWatchers1e3(b *testing.B) { benchmarkWatchers(1e3, b) }
+func BenchmarkWatchers1e5(b *testing.B) { benchmarkWatchers(1e5, b) }
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+)
+
+// A Difference describes a file that is not the same in two revs of the
+// store. OldRev is Missing if the file was added; NewRev is Missing if it
+// was removed.
+type Difference struct {
+	Path    string
+	OldBody string
+	OldRev  int64
+	NewBody string
+	NewRev  int64
+}
+
+// Returns every file matching glob that differs between revs a and b,
+// in path order.
+//
+// If either rev is less than 1 or later than the current rev, Diff will
+// return ErrNoRev. If either is less than any value passed to st.Clean,
+// and is not the current rev, Diff will return ErrTooLate.
+func (st *Store) Diff(glob *Glob, a, b int64) ([]Difference, error) {
+	na, err := st.tree(a)
+	if err != nil {
+		return nil, err
+	}
+
+	nb, err := st.tree(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff(glob, na, nb), nil
+}
+
+// Returns the tree as of rev, which must not be later than the current
+// rev.
+func (st *Store) tree(rev int64) (node, error) {
+	ver, g := st.Snap()
+	switch {
+	case rev < 1 || rev > ver:
+		return node{}, ErrNoRev
+	case rev == ver:
+		return g.(node), nil
+	}
+
+	// rev is in the log, if it hasn't been cleaned, so this doesn't block.
+	ch, err := st.Wait(Any, rev)
+	if err != nil {
+		return node{}, err
+	}
+	ev, ok := <-ch
+	if !ok {
+		return node{}, ErrClosed
+	}
+	return ev.Getter.(node), nil
+}
+
+func diff(glob *Glob, a, b node) (ds []Difference) {
+	// Nothing outside the literal prefix of glob can match.
+	prefix := literalPrefix(glob.Pattern)
+	a, _ = a.at(prefix)
+	b, _ = b.at(prefix)
+	diffAt(join(prefix), a, b, glob, &ds)
+	return ds
+}
+
+func diffAt(path string, a, b node, glob *Glob, ds *[]Difference) {
+	if len(a.Ds) > 0 && len(b.Ds) > 0 && sameMap(a.Ds, b.Ds) {
+		return // a shared subtree
+	}
+
+	if (a.Rev > 0 || b.Rev > 0) && a.Rev != b.Rev && glob.Match(path) {
+		d := Difference{Path: path}
+		if a.Rev > 0 {
+			d.OldBody, d.OldRev = a.V, a.Rev
+		}
+		if b.Rev > 0 {
+			d.NewBody, d.NewRev = b.V, b.Rev
+		}
+		*ds = append(*ds, d)
+	}
+
+	var names []string
+	for name := range a.Ds {
+		names = append(names, name)
+	}
+	for name := range b.Ds {
+		if _, ok := a.Ds[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if path == "/" {
+		path = ""
+	}
+	for _, name := range names {
+		diffAt(path+"/"+name, a.Ds[name], b.Ds[name], glob, ds)
+	}
+}
+
+func sameMap(a, b map[string]node) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
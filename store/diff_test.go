@@ -0,0 +1,73 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a, _ := emptyDir.apply(1, MustEncodeSet("/config/x", "1", Clobber))
+	a, _ = a.apply(2, MustEncodeSet("/config/y", "1", Clobber))
+	a, _ = a.apply(3, MustEncodeSet("/config/sub/z", "1", Clobber))
+	a, _ = a.apply(4, MustEncodeSet("/other", "1", Clobber))
+
+	b, _ := a.apply(5, MustEncodeSet("/config/x", "2", Clobber))
+	b, _ = b.apply(6, MustEncodeDel("/config/y", Clobber))
+	b, _ = b.apply(7, MustEncodeSet("/config/w", "3", Clobber))
+	b, _ = b.apply(8, MustEncodeSet("/other", "2", Clobber))
+
+	exp := []Difference{
+		{"/config/w", "", Missing, "3", 7},
+		{"/config/x", "1", 1, "2", 5},
+		{"/config/y", "1", 2, "", Missing},
+	}
+	assert.Equal(t, exp, diff(MustCompileGlob("/config/**"), a, b))
+	assert.Equal(t, 4, len(diff(Any, a, b)))
+	assert.Equal(t, 0, len(diff(Any, a, a)))
+	assert.Equal(t, []Difference{{"/config/x", "2", 5, "1", 1}}, diff(MustCompileGlob("/config/x"), b, a))
+}
+
+func TestDiffFileBecomesDir(t *testing.T) {
+	a, _ := emptyDir.apply(1, MustEncodeSet("/x", "1", Clobber))
+	b, _ := a.apply(2, MustEncodeDel("/x", Clobber))
+	b, _ = b.apply(3, MustEncodeSet("/x/y", "2", Clobber))
+
+	exp := []Difference{
+		{"/x", "1", 1, "", Missing},
+		{"/x/y", "", Missing, "2", 3},
+	}
+	assert.Equal(t, exp, diff(Any, a, b))
+}
+
+func TestStoreDiff(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/y", "3", Clobber)}
+	sync(st, 3)
+
+	ds, err := st.Diff(Any, 1, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Difference{
+		{"/x", "1", 1, "2", 2},
+		{"/y", "", Missing, "3", 3},
+	}, ds)
+
+	st.Clean(1)
+	_, err = st.Diff(Any, 1, 3)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestStoreDiffNoRev(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	sync(st, 1)
+
+	for _, revs := range [][2]int64{{0, 1}, {-1, 1}, {1, 2}, {2, 1}} {
+		_, err := st.Diff(Any, revs[0], revs[1])
+		assert.Equalf(t, ErrNoRev, err, "%v", revs)
+	}
+	assert.Equal(t, 0, <-st.Waiting)
+}
@@ -14,10 +14,49 @@ type Event struct {
 
 	Err error
 
+	// for a mutation that changes several files at once, one event for
+	// each file changed, in order. Watchers receive these instead of e.
+	Changes []Event
+
 	// retrieves values as defined at `Seqn`
 	Getter
 }
 
+// Returns the event watchers of glob should receive for e, if any: the
+// first change to a matching file, after passing over skip of them.
+func (e Event) match(glob *Glob, skip int) (Event, bool) {
+	if len(e.Changes) == 0 {
+		return e, skip <= 0 && glob.Match(e.Path)
+	}
+
+	for _, c := range e.Changes {
+		if glob.Match(c.Path) {
+			if skip <= 0 {
+				return c, true
+			}
+			skip--
+		}
+	}
+	return Event{}, false
+}
+
+// Returns every event watchers of glob should receive for e, in order.
+func (e Event) matches(glob *Glob) (a []Event) {
+	if len(e.Changes) == 0 {
+		if glob.Match(e.Path) {
+			a = append(a, e)
+		}
+		return a
+	}
+
+	for _, c := range e.Changes {
+		if glob.Match(c.Path) {
+			a = append(a, c)
+		}
+	}
+	return a
+}
+
 func (e Event) Desc() string {
 	switch {
 	case e.IsSet():
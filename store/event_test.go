@@ -8,7 +8,7 @@ import (
 func TestEventIsSet(t *testing.T) {
 	p, v := "/x", "a"
 	m := MustEncodeSet(p, v, Clobber)
-	ev := Event{1, p, v, 1, m, nil, nil}
+	ev := Event{1, p, v, 1, m, nil, nil, nil}
 	assert.Equal(t, true, ev.IsSet())
 	assert.Equal(t, false, ev.IsDel())
 	assert.Equal(t, false, ev.IsNop())
@@ -17,7 +17,7 @@ func TestEventIsSet(t *testing.T) {
 func TestEventIsDel(t *testing.T) {
 	p := "/x"
 	m := MustEncodeDel(p, Clobber)
-	ev := Event{1, p, "", Missing, m, nil, nil}
+	ev := Event{1, p, "", Missing, m, nil, nil, nil}
 	assert.Equal(t, true, ev.IsDel())
 	assert.Equal(t, false, ev.IsSet())
 	assert.Equal(t, false, ev.IsNop())
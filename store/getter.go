@@ -7,6 +7,8 @@ import (
 type Getter interface {
 	Get(path string) (values []string, rev int64)
 	Stat(path string) (ln int32, rev int64)
+	Usage(path string) (keys, bytes int64)
+	DirRevs(path string) (created, changed int64)
 }
 
 // Retrieves the body stored in `g` at `path` and returns it. If `path` is a
@@ -42,14 +44,17 @@ func Getdir(g Getter, path string) (entries []string) {
 
 type Visitor func(path, body string, rev int64) (stop bool)
 
-func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
+// Walks the tree at path. If after is not nil, it holds the rest of the
+// components of a path under path, and only files that come after that path
+// are visited.
+func walk(g Getter, path string, after []string, glob *Glob, f Visitor) (stopped bool) {
 	v, rev := g.Get(path)
 	if rev == Missing {
 		return
 	}
 
 	if rev != Dir {
-		return glob.Match(path) && f(path, v[0], rev)
+		return after == nil && glob.Match(path) && f(path, v[0], rev)
 	}
 
 	if path == "/" {
@@ -58,7 +63,20 @@ func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
 
 	sort.Strings(v)
 	for _, ent := range v {
-		stopped = walk(g, path+"/"+ent, glob, f)
+		if ent == "" {
+			continue // an empty root dir
+		}
+
+		var rest []string
+		if len(after) > 0 {
+			if ent < after[0] {
+				continue
+			}
+			if ent == after[0] {
+				rest = after[1:]
+			}
+		}
+		stopped = walk(g, path+"/"+ent, rest, glob, f)
 		if stopped {
 			return
 		}
@@ -72,6 +90,35 @@ func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
 // Walk won't call f again.
 // Walk returns true if f returned true.
 func Walk(g Getter, glob *Glob, f Visitor) (stopped bool) {
-	// TODO find the longest non-glob prefix of glob.Pattern and start there
-	return walk(g, "/", glob, f)
+	return walk(g, globRoot(glob.Pattern), nil, glob, f)
+}
+
+// WalkAfter is like Walk, but only visits the files that Walk would visit
+// after the one at path, which need not exist. Path must be valid.
+func WalkAfter(g Getter, glob *Glob, path string, f Visitor) (stopped bool) {
+	root := globRoot(glob.Pattern)
+	r, after := split(root), split(path)
+	for i := range r {
+		if i == len(after) || after[i] < r[i] {
+			after = nil // all of root comes after path
+			break
+		}
+		if after[i] > r[i] {
+			return false // none of it does
+		}
+	}
+	if after != nil {
+		after = after[len(r):]
+	}
+	return walk(g, root, after, glob, f)
+}
+
+// Returns the deepest directory that holds every path pat can match: its
+// literal prefix, less the last element if that is all of pat.
+func globRoot(pat string) string {
+	parts := literalPrefix(pat)
+	if len(parts) > 0 && join(parts) == pat {
+		parts = parts[:len(parts)-1]
+	}
+	return join(parts)
 }
@@ -125,3 +125,72 @@ func TestWalkStop(t *testing.T) {
 	assert.Equal(t, true, b)
 	assert.Equal(t, 1, c)
 }
+
+func TestWalkAfter(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/a-c", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/a/b", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/a/c/d", "3", Clobber)}
+	st.Ops <- Op{4, MustEncodeSet("/a/e", "4", Clobber)}
+	st.Ops <- Op{5, MustEncodeSet("/b", "5", Clobber)}
+	sync(st, 5)
+
+	walkAfter := func(after string) (got []string) {
+		WalkAfter(st, Any, after, func(path, body string, rev int64) bool {
+			got = append(got, path)
+			return false
+		})
+		return got
+	}
+
+	all := []string{"/a/b", "/a/c/d", "/a/e", "/a-c", "/b"}
+	assert.Equal(t, all, walkAfter("/"))
+	assert.Equal(t, all[1:], walkAfter("/a/b"))
+	assert.Equal(t, all[2:], walkAfter("/a/c/d"))
+	assert.Equal(t, all[1:], walkAfter("/a/c"))  // a directory
+	assert.Equal(t, all[1:], walkAfter("/a/bb")) // missing
+	assert.Equal(t, all[3:], walkAfter("/a/e"))
+	assert.Equal(t, all[3:], walkAfter("/a/e/f")) // under a file
+	assert.Equal(t, []string(nil), walkAfter("/b"))
+}
+
+func TestGlobRoot(t *testing.T) {
+	for pat, exp := range map[string]string{
+		"/":            "/",
+		"/**":          "/",
+		"/a":           "/",
+		"/a/b":         "/a",
+		"/a/b/**":      "/a/b",
+		"/a/b*/c":      "/a",
+		"/a/{b,c}/d":   "/a",
+		"/a/[bc]/d":    "/a",
+		"/a/b/**!/a/c": "/a/b",
+		"{/a,/b}":      "/",
+		"/x{a,b}/c":    "/",
+	} {
+		assert.Equalf(t, exp, globRoot(pat), "%q", pat)
+	}
+}
+
+func TestWalkAfterUnderRoot(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/a/b", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/c/d", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/c/e", "3", Clobber)}
+	st.Ops <- Op{4, MustEncodeSet("/d", "4", Clobber)}
+	sync(st, 4)
+
+	glob := MustCompileGlob("/c/*")
+	walkAfter := func(after string) (got []string) {
+		WalkAfter(st, glob, after, func(path, body string, rev int64) bool {
+			got = append(got, path)
+			return false
+		})
+		return got
+	}
+
+	assert.Equal(t, []string{"/c/d", "/c/e"}, walkAfter("/a/b"))
+	assert.Equal(t, []string{"/c/d", "/c/e"}, walkAfter("/c"))
+	assert.Equal(t, []string{"/c/e"}, walkAfter("/c/d"))
+	assert.Equal(t, []string(nil), walkAfter("/d"))
+}
@@ -9,36 +9,72 @@ import (
 // matching against paths.
 //
 // Glob notation:
-//  - `?` matches a single char in a single path component
-//  - `*` matches zero or more chars in a single path component
-//  - `**` matches zero or more chars in zero or more components
-//  - any other sequence matches itself
+//   - `?` matches a single char in a single path component
+//   - `*` matches zero or more chars in a single path component
+//   - `**` matches zero or more chars in zero or more components
+//   - `[abc]` matches one of the chars listed, and `[a-f]` one in the range;
+//     `[!abc]` and `[^abc]` match a single char not listed
+//   - `{a,b}` matches any one of the comma-separated patterns listed
+//   - `pat!exc` matches what pat matches, unless it also matches exc;
+//     there can be any number of exclusions
+//   - any other sequence matches itself
 type Glob struct {
 	Pattern string         // original glob pattern
 	s       string         // translated to regexp pattern
 	r       *regexp.Regexp // compiled regexp
+	not     *regexp.Regexp // exclusions, if any
 }
 
-var globRe = mustBuildRe(`(` + charPat + `|[\*\?])`)
+const classPat = `\[[!^]?` + charPat + `+\]`
 
-// Supports unix/ruby-style glob patterns:
-//  - `?` matches a single char in a single path component
-//  - `*` matches zero or more chars in a single path component
-//  - `**` matches zero or more chars in zero or more components
+var globRe = mustBuildRe(`(` + charPat + `|[\*\?]|` + classPat + `)`)
+
+// Limits how many patterns braces can expand into.
+const maxAlternatives = 1024
+
+// Supports unix/ruby-style glob patterns, as described for Glob, except
+// for exclusions.
 func translateGlob(pat string) (string, error) {
+	alts, err := expandBraces(pat)
+	if err != nil {
+		return "", err
+	}
+
+	outs := make([]string, len(alts))
+	for i, alt := range alts {
+		outs[i], err = translateAlt(alt)
+		if err != nil {
+			return "", GlobError(pat)
+		}
+	}
+
+	if len(outs) == 1 {
+		return "^" + outs[0] + "$", nil
+	}
+	return "^(?:" + strings.Join(outs, "|") + ")$", nil
+}
+
+// Translates a pattern with no braces, without anchoring it.
+func translateAlt(pat string) (string, error) {
 	if !globRe.MatchString(pat) {
 		return "", GlobError(pat)
 	}
 
 	outs := make([]string, len(pat))
 	i, double := 0, false
-	for _, c := range pat {
+	for j := 0; j < len(pat); j++ {
+		c := pat[j]
 		switch c {
 		default:
-			outs[i] = string(c)
+			outs[i] = pat[j : j+1] // may be part of a multibyte char
+			double = false
+		case '.', '+', '-', '^', '$', '(', ')':
+			outs[i] = `\` + pat[j:j+1]
 			double = false
-		case '.', '+', '-', '^', '$', '[', ']', '(', ')':
-			outs[i] = `\` + string(c)
+		case '[':
+			n := strings.IndexByte(pat[j:], ']')
+			outs[i] = translateClass(pat[j+1 : j+n])
+			j += n
 			double = false
 		case '?':
 			outs[i] = `[^/]`
@@ -55,23 +91,119 @@ func translateGlob(pat string) (string, error) {
 	}
 	outs = outs[0:i]
 
-	return "^" + strings.Join(outs, "") + "$", nil
+	return strings.Join(outs, ""), nil
+}
+
+// Translates the inside of a bracket class. A class never matches `/`.
+func translateClass(class string) string {
+	if class[0] == '!' || class[0] == '^' {
+		return `[^/` + strings.Replace(class[1:], `.`, `\.`, -1) + `]`
+	}
+	return `[` + strings.Replace(class, `.`, `\.`, -1) + `]`
+}
+
+// Returns the patterns that pat stands for, once the alternatives in each
+// pair of braces are expanded, in order.
+func expandBraces(pat string) ([]string, error) {
+	open := strings.IndexByte(pat, '{')
+	if open < 0 {
+		if strings.ContainsAny(pat, ",}") {
+			return nil, GlobError(pat)
+		}
+		return []string{pat}, nil
+	}
+
+	// Find the matching brace, and the commas between them.
+	var alts []string
+	depth, start := 0, open+1
+	for i := open; i < len(pat); i++ {
+		switch pat[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alts = append(alts, pat[start:i])
+				start = i + 1
+			}
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			alts = append(alts, pat[start:i])
+			pre, post := pat[:open], pat[i+1:]
+			if strings.ContainsAny(pre, ",}") {
+				return nil, GlobError(pat)
+			}
+
+			var pats []string
+			for _, alt := range alts {
+				more, err := expandBraces(pre + alt + post)
+				if err != nil {
+					return nil, GlobError(pat)
+				}
+				pats = append(pats, more...)
+				if len(pats) > maxAlternatives {
+					return nil, GlobError(pat)
+				}
+			}
+			return pats, nil
+		}
+	}
+	return nil, GlobError(pat) // unbalanced
+}
+
+// Splits pat at each `!` that is not inside brackets.
+func splitExclusions(pat string) []string {
+	var parts []string
+	start, class := 0, false
+	for i := 0; i < len(pat); i++ {
+		switch pat[i] {
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '!':
+			if !class {
+				parts = append(parts, pat[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, pat[start:])
 }
 
 // CompileGlob translates pat into a form more convenient for
 // matching against paths in the store.
 func CompileGlob(pat string) (*Glob, error) {
-	s, err := translateGlob(pat)
+	parts := splitExclusions(pat)
+
+	s, err := translateGlob(parts[0])
 	if err != nil {
-		return nil, err
+		return nil, GlobError(pat)
 	}
 
 	r, err := regexp.Compile(s)
 	if err != nil {
-		return nil, err
+		return nil, GlobError(pat)
 	}
 
-	return &Glob{pat, s, r}, nil
+	g := &Glob{Pattern: pat, s: s, r: r}
+	if len(parts) > 1 {
+		nots := make([]string, len(parts)-1)
+		for i, p := range parts[1:] {
+			nots[i], err = translateGlob(p)
+			if err != nil {
+				return nil, GlobError(pat)
+			}
+		}
+		g.not, err = regexp.Compile(strings.Join(nots, "|"))
+		if err != nil {
+			return nil, GlobError(pat)
+		}
+	}
+	return g, nil
 }
 
 // MustCompileGlob is like CompileGlob, but it panics if an error occurs,
@@ -85,7 +217,7 @@ func MustCompileGlob(pat string) *Glob {
 }
 
 func (g *Glob) Match(path string) bool {
-	return g.r.MatchString(path)
+	return g.r.MatchString(path) && (g.not == nil || !g.not.MatchString(path))
 }
 
 type GlobError string
@@ -20,6 +20,17 @@ var globs = [][]string{
 	{"/*a*/b", `^/[^/]*a[^/]*/b$`},
 	{"/**", `^/.*$`},
 	{"/**/a", `^/.*/a$`},
+	{"/[abc]", `^/[abc]$`},
+	{"/[a-f]*", `^/[a-f][^/]*$`},
+	{"/[!a.]", `^/[^/a\.]$`},
+	{"/[^a]", `^/[^/a]$`},
+	{"/{a,b}", `^(?:/a|/b)$`},
+	{"/a{,.b}", `^(?:/a|/a\.b)$`},
+	{"/{a,b{c,d}}/e", `^(?:/a/e|/bc/e|/bd/e)$`},
+	{"/{a,b/c}", `^(?:/a|/b/c)$`},
+	{"/a_b", `^/a_b$`},
+	{"/世界/*", `^/世界/[^/]*$`},
+	{"/[à-ÿ]", `^/[à-ÿ]$`},
 }
 
 var matches = [][]string{
@@ -27,6 +38,14 @@ var matches = [][]string{
 	{"/a?", "/ab", "/ac"},
 	{"/a*", "/a", "/ab", "/abc"},
 	{"/a**", "/a", "/ab", "/abc", "/a/", "/a/b", "/ab/c"},
+	{"/hosts/[a-f]*", "/hosts/a", "/hosts/beta", "/hosts/f1"},
+	{"/[!a]", "/b", "/1"},
+	{"/svc/{web,api}/*", "/svc/web/x", "/svc/api/y"},
+	{"/svc/*!/svc/tmp*", "/svc/web", "/svc/api"},
+	{"/a/**!/a/b/**!/a/c", "/a/d", "/a/b", "/a/cc"},
+	{"/svc/my_*", "/svc/my_service", "/svc/my_"},
+	{"/h/?", "/h/é", "/h/世"},
+	{"/h/caf[à-ÿ]", "/h/café"},
 }
 
 var nonMatches = [][]string{
@@ -34,6 +53,13 @@ var nonMatches = [][]string{
 	{"/a?", "/", "/abc", "/a", "/a/"},
 	{"/a*", "/", "/a/", "/ba"},
 	{"/a**", "/", "/ba"},
+	{"/hosts/[a-f]*", "/hosts/g", "/hosts/", "/hosts/A"},
+	{"/[!a]", "/a", "//"},
+	{"/svc/{web,api}/*", "/svc/db/x", "/svc/web"},
+	{"/svc/*!/svc/tmp*", "/svc/tmp", "/svc/tmp1"},
+	{"/a/**!/a/b/**!/a/c", "/a/b/x", "/a/c"},
+	{"/h/?", "/h/世界", "/h/"},
+	{"/h/caf[à-ÿ]", "/h/cafe"},
 }
 
 var dontCompile = []string{
@@ -51,7 +77,19 @@ var dontCompile = []string{
 	"/a]b",
 	"/a(b",
 	"/a)b",
-	"/a世界",
+	"/a\xff",
+	"/a☃",
+	"/a{b",
+	"/a}b",
+	"/a,b",
+	"/{a,}b}",
+	"/{a,/}",
+	"/[]",
+	"/[a/b]",
+	"!/a",
+	"/a!",
+	"/a!b",
+	"/{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}",
 }
 
 func TestGlobTranslateOk(t *testing.T) {
@@ -82,6 +120,11 @@ func TestGlobTranslateError(t *testing.T) {
 	}
 }
 
+func TestGlobBadRange(t *testing.T) {
+	_, err := CompileGlob("/[z-a]")
+	assert.Equal(t, GlobError("/[z-a]"), err)
+}
+
 func TestGlobMatches(t *testing.T) {
 	for _, parts := range matches {
 		pat, paths := parts[0], parts[1:]
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"strings"
+)
+
+// A watchIndex holds watches in a trie over the path components of the
+// literal prefix of their globs, so that an event is only tested against
+// the watches that could match it: those stored along the path of each
+// file it changes.
+type watchIndex struct {
+	ws   []*watch
+	kids map[string]*watchIndex
+	n    int // number of watches here and below
+}
+
+// Returns the leading components of pat that contain no special chars.
+// Any path that matches pat must start with them.
+func literalPrefix(pat string) []string {
+	if i := strings.IndexAny(pat, "*?[{!"); i >= 0 {
+		if pat[i] == '!' {
+			pat = pat[:i] // exclusions only narrow the match
+		} else {
+			pat = pat[:strings.LastIndex(pat[:i], "/")+1]
+		}
+	}
+
+	if !strings.HasPrefix(pat, "/") {
+		return []string{} // as in {/a,/b}: no component is literal
+	}
+	if len(pat) > 1 {
+		pat = strings.TrimSuffix(pat, "/")
+	}
+	return split(pat)
+}
+
+func (x *watchIndex) add(w *watch) {
+	for _, p := range literalPrefix(w.glob.Pattern) {
+		x.n++
+		if x.kids == nil {
+			x.kids = map[string]*watchIndex{}
+		}
+		k := x.kids[p]
+		if k == nil {
+			k = new(watchIndex)
+			x.kids[p] = k
+		}
+		x = k
+	}
+	x.n++
+	x.ws = append(x.ws, w)
+}
+
+// Calls f for each watch stored along path, from the root down.
+func (x *watchIndex) along(path string, f func(*watch)) {
+	if !strings.HasPrefix(path, "/") {
+		return // not a path; nothing can match it
+	}
+
+	for _, p := range split(path) {
+		for _, w := range x.ws {
+			f(w)
+		}
+		if x = x.kids[p]; x == nil {
+			return
+		}
+	}
+	for _, w := range x.ws {
+		f(w)
+	}
+}
+
+// Sends e to each watch that it matches, and removes those watches.
+func (x *watchIndex) notify(e Event) {
+	var fired []*watch
+	try := func(w *watch) {
+		if w.fired || e.Seqn < w.rev {
+			return
+		}
+		if m, ok := e.match(w.glob, w.skipAt(e.Seqn)); ok {
+			if w.all {
+				m = e
+			}
+			w.c <- m
+			w.fired = true
+			fired = append(fired, w)
+		}
+	}
+
+	if len(e.Changes) == 0 {
+		x.along(e.Path, try)
+	} else {
+		for _, c := range e.Changes {
+			x.along(c.Path, try)
+		}
+	}
+
+	for _, w := range fired {
+		x.remove(w)
+	}
+}
+
+// Removes w, if it is present, and reports whether it was.
+func (x *watchIndex) remove(w *watch) bool {
+	return x.removeAt(literalPrefix(w.glob.Pattern), w)
+}
+
+func (x *watchIndex) removeAt(parts []string, w *watch) bool {
+	if len(parts) == 0 {
+		for i, v := range x.ws {
+			if v == w {
+				x.ws = append(x.ws[:i], x.ws[i+1:]...)
+				x.n--
+				return true
+			}
+		}
+		return false
+	}
+
+	k := x.kids[parts[0]]
+	if k == nil || !k.removeAt(parts[1:], w) {
+		return false
+	}
+	if k.n == 0 {
+		delete(x.kids, parts[0])
+	}
+	x.n--
+	return true
+}
+
+// Returns the watch for glob that sends on c, or nil if there is none.
+func (x *watchIndex) find(glob *Glob, c <-chan Event) *watch {
+	for _, p := range literalPrefix(glob.Pattern) {
+		if x = x.kids[p]; x == nil {
+			return nil
+		}
+	}
+	for _, w := range x.ws {
+		if w.c == c {
+			return w
+		}
+	}
+	return nil
+}
+
+// Calls f for every watch in x.
+func (x *watchIndex) each(f func(*watch)) {
+	for _, w := range x.ws {
+		f(w)
+	}
+	for _, k := range x.kids {
+		k.each(f)
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestLiteralPrefix(t *testing.T) {
+	assert.Equal(t, []string{}, literalPrefix("/"))
+	assert.Equal(t, []string{}, literalPrefix("/**"))
+	assert.Equal(t, []string{"a", "b"}, literalPrefix("/a/b"))
+	assert.Equal(t, []string{"a"}, literalPrefix("/a/b*/c"))
+	assert.Equal(t, []string{"a"}, literalPrefix("/a/?"))
+	assert.Equal(t, []string{"a"}, literalPrefix("/a/[bc]"))
+	assert.Equal(t, []string{"a"}, literalPrefix("/a/{b,c/d}"))
+	assert.Equal(t, []string{"a", "b"}, literalPrefix("/a/b!/a/b/c"))
+	assert.Equal(t, []string{}, literalPrefix("{/a,/b}"))
+	assert.Equal(t, []string{}, literalPrefix("/x{a,b}/c"))
+	assert.Equal(t, []string{}, literalPrefix("/x*"))
+}
+
+func newWatch(pat string) (*watch, chan Event) {
+	c := make(chan Event, 1)
+	return &watch{glob: MustCompileGlob(pat), rev: 1, c: c}, c
+}
+
+func TestWatchIndexNotify(t *testing.T) {
+	var x watchIndex
+	wa, ca := newWatch("/a/b")
+	wb, cb := newWatch("/a/*")
+	wc, cc := newWatch("/c/**")
+	wd, cd := newWatch("/**")
+	for _, w := range []*watch{wa, wb, wc, wd} {
+		x.add(w)
+	}
+	assert.Equal(t, 4, x.n)
+
+	x.notify(Event{Seqn: 1, Path: "/a/b"})
+	assert.Equal(t, 1, len(ca))
+	assert.Equal(t, 1, len(cb))
+	assert.Equal(t, 0, len(cc))
+	assert.Equal(t, 1, len(cd))
+	assert.Equal(t, 1, x.n)
+	assert.Equal(t, 1, len(x.kids)) // only /c is left
+
+	x.notify(Event{Seqn: 2, Path: "/c/d/e"})
+	assert.Equal(t, 1, len(cc))
+	assert.Equal(t, 0, x.n)
+}
+
+func TestWatchIndexNotifyChanges(t *testing.T) {
+	var x watchIndex
+	wa, ca := newWatch("/a/*")
+	x.add(wa)
+	ev := Event{Seqn: 1, Path: "/", Rev: nop, Changes: []Event{
+		{Seqn: 1, Path: "/a/x"},
+		{Seqn: 1, Path: "/a/y"},
+	}}
+	x.notify(ev)
+	assert.Equal(t, "/a/x", (<-ca).Path)
+	assert.Equal(t, 0, x.n)
+}
+
+func TestWatchIndexRemove(t *testing.T) {
+	var x watchIndex
+	wa, _ := newWatch("/a/b/c")
+	wb, _ := newWatch("/a/b/c")
+	x.add(wa)
+	x.add(wb)
+	assert.T(t, x.remove(wa))
+	assert.T(t, !x.remove(wa))
+	assert.Equal(t, 1, x.n)
+	assert.T(t, x.remove(wb))
+	assert.Equal(t, 0, x.n)
+	assert.Equal(t, 0, len(x.kids))
+}
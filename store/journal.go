@@ -0,0 +1,88 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+)
+
+// A mutation that can't be applied is recorded in the journal under
+// ErrorPath, in a directory named for its seqn, which holds:
+//
+//	mut       the mutation, in the text form if it can be decoded
+//	err       why it couldn't be applied
+//	proposer  the node that proposed it, if known
+//
+// Only the most recent MaxErrors entries are kept; the oldest is deleted to
+// make room for each new one.
+const MaxErrors = 100
+
+// Records in n's journal that mut, proposed by proposer, could not be
+// applied at seqn because of err. The event has one change for each file
+// set or deleted in the journal, the new entry's first. Watchers receive
+// the changes rather than the event, so each of them has the error too.
+func (n node) journal(seqn int64, mut, proposer string, err error) (rep node, ev Event) {
+	ev.Seqn, ev.Path, ev.Body, ev.Rev, ev.Mut, ev.Err = seqn, "/", err.Error(), nop, mut, err
+
+	// Make room for the new entry first, but list its changes first.
+	rep = n
+	var dels []Event
+	del := func(path string) {
+		t, _ := rep.at(split(path))
+		var paths []string
+		t.each(path, func(path, _ string, _ int64) error {
+			paths = append(paths, path)
+			return nil
+		})
+		sort.Strings(paths)
+		for _, p := range paths {
+			c := Event{Seqn: seqn, Path: p, Rev: Missing, Mut: mut, Err: err}
+			dels = append(dels, c)
+		}
+		rep = rep.setp(seqn, path, "", Missing, false)
+	}
+
+	var names []int64
+	ents, rev := n.Get(ErrorPath)
+	switch rev {
+	case Dir:
+		for _, s := range ents {
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err == nil && strconv.FormatInt(i, 10) == s {
+				names = append(names, i)
+			}
+		}
+	case Missing:
+	default:
+		// Older versions kept only the last error, in a file at ErrorPath.
+		del(ErrorPath)
+	}
+
+	sort.Sort(int64s(names))
+	for len(names) >= MaxErrors {
+		del(ErrorPath + "/" + strconv.FormatInt(names[0], 10))
+		names = names[1:]
+	}
+
+	dir := ErrorPath + "/" + strconv.FormatInt(seqn, 10)
+	files := []struct{ name, body string }{
+		{"err", err.Error()},
+		{"mut", readable(mut)},
+		{"proposer", proposer},
+	}
+	for _, f := range files {
+		if f.body == "" {
+			continue
+		}
+		path := dir + "/" + f.name
+		rep = rep.setp(seqn, path, f.body, seqn, true)
+		c := Event{Seqn: seqn, Path: path, Body: f.body, Rev: seqn, Mut: mut, Err: err}
+		ev.Changes = append(ev.Changes, c)
+	}
+	ev.Changes = append(ev.Changes, dels...)
+
+	ev.Getter = rep
+	for i := range ev.Changes {
+		ev.Changes[i].Getter = rep
+	}
+	return
+}
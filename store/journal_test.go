@@ -0,0 +1,96 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"strconv"
+	"testing"
+)
+
+// Returns n with a journal entry for mut, which failed at seqn with err.
+func journaled(n node, seqn int64, mut string, err error) node {
+	p := ErrorPath + "/" + strconv.FormatInt(seqn, 10)
+	n = n.setp(seqn, p+"/err", err.Error(), seqn, true)
+	if mut != "" {
+		n = n.setp(seqn, p+"/mut", readable(mut), seqn, true)
+	}
+	return n
+}
+
+func assertJournaled(t *testing.T, seqn int64, mut string, err error, n node, e Event) {
+	p := ErrorPath + "/" + strconv.FormatInt(seqn, 10)
+	changes := []Event{{seqn, p + "/err", err.Error(), seqn, mut, err, nil, n}}
+	if mut != "" {
+		changes = append(changes, Event{seqn, p + "/mut", readable(mut), seqn, mut, err, nil, n})
+	}
+	assert.Equal(t, Event{seqn, "/", err.Error(), nop, mut, err, changes, n}, e)
+}
+
+func TestJournalEntry(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m := MustEncodeSet("/x", "b", 0)
+	n, e := r.apply(2, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+	assert.Equal(t, ErrRevMismatch.Error(), GetString(n, "/ctl/err/2/err"))
+	assert.Equal(t, "0:/x=b", GetString(n, "/ctl/err/2/mut"))
+	assert.Equal(t, "", GetString(n, "/ctl/err/2/proposer"))
+	assert.Equal(t, "a", GetString(n, "/x"))
+}
+
+func TestJournalProposer(t *testing.T) {
+	m := WithProposer(MustEncodeSet("/x", "a", -5), "abc")
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+	assert.Equal(t, "abc", GetString(n, "/ctl/err/1/proposer"))
+	assert.Equal(t, "-5:/x=a", GetString(n, "/ctl/err/1/mut"))
+	assert.Equal(t, []Event{
+		{1, "/ctl/err/1/err", ErrRevMismatch.Error(), 1, m, ErrRevMismatch, nil, n},
+		{1, "/ctl/err/1/mut", "-5:/x=a", 1, m, ErrRevMismatch, nil, n},
+		{1, "/ctl/err/1/proposer", "abc", 1, m, ErrRevMismatch, nil, n},
+	}, e.Changes)
+}
+
+func TestJournalBadMutation(t *testing.T) {
+	m := "\x00\x01\xff"
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, ErrBadMutation, e.Err)
+	assert.Equal(t, m, GetString(n, "/ctl/err/1/mut"))
+}
+
+func TestJournalBounded(t *testing.T) {
+	n := emptyDir
+	for i := int64(1); i <= MaxErrors; i++ {
+		n, _ = n.apply(i, MustEncodeSet("/x", "a", -5))
+	}
+	names, _ := n.Get(ErrorPath)
+	assert.Equal(t, MaxErrors, len(names))
+
+	m := MustEncodeSet("/x", "a", -5)
+	n, e := n.apply(MaxErrors+1, m)
+	names, _ = n.Get(ErrorPath)
+	assert.Equal(t, MaxErrors, len(names))
+	_, rev := n.Get("/ctl/err/1")
+	assert.Equal(t, Missing, rev)
+	_, rev = n.Get("/ctl/err/2")
+	assert.Equal(t, Dir, rev)
+	_, rev = n.Get("/ctl/err/101")
+	assert.Equal(t, Dir, rev)
+	assert.Equal(t, []Event{
+		{101, "/ctl/err/101/err", ErrRevMismatch.Error(), 101, m, ErrRevMismatch, nil, n},
+		{101, "/ctl/err/101/mut", "-5:/x=a", 101, m, ErrRevMismatch, nil, n},
+		{101, "/ctl/err/1/err", "", Missing, m, ErrRevMismatch, nil, n},
+		{101, "/ctl/err/1/mut", "", Missing, m, ErrRevMismatch, nil, n},
+	}, e.Changes)
+}
+
+func TestJournalReplacesOldFile(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet(ErrorPath, "old error", Clobber))
+	n, e := r.apply(2, MustEncodeSet("/x", "a", -5))
+	assert.Equal(t, ErrRevMismatch.Error(), GetString(n, "/ctl/err/2/err"))
+	assert.Equal(t, Event{2, ErrorPath, "", Missing, e.Mut, ErrRevMismatch, nil, n}, e.Changes[2])
+	assert.Equal(t, journaled(emptyDir, 2, e.Mut, ErrRevMismatch), n)
+}
+
+func TestWithProposerText(t *testing.T) {
+	assert.Equal(t, "0:/x=a", WithProposer("0:/x=a", "abc"))
+	assert.Equal(t, "\x00\x01\xff", WithProposer("\x00\x01\xff", "abc"))
+}
@@ -0,0 +1,542 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync" // the tests define their own sync
+)
+
+// File name prefixes in a log directory. Each is followed by a seqn.
+const (
+	segPrefix  = "log-"
+	snapPrefix = "snap-"
+	tmpSuffix  = ".tmp"
+)
+
+// Size of a log record header: seqn, length of mut, checksum.
+const recHeaderLen = 8 + 4 + 4
+
+// In a snapshot, a record for a directory, rather than a file, holds this
+// followed by the directory's Changed seqn, `:`, and its path.
+const dirRecPrefix = "dir:"
+
+// No sane mutation is this long; a record that claims to be is corrupt.
+const maxMutLen = 1 << 24
+
+var (
+	ErrBadRecord   = errors.New("bad log record")
+	ErrBadSnapshot = errors.New("bad snapshot")
+)
+
+// Log is a write-ahead log of the operations applied to a Store, plus
+// periodic snapshots of the store's contents. It lives in a single
+// directory on disk. Every record is synced to disk before the operation
+// it holds is applied, so a store rebuilt from the log comes back at the
+// last seqn it applied.
+//
+// Records are kept in segments, files named for the first seqn they
+// hold. Each snapshot starts a new segment, and segments that hold
+// nothing newer than the snapshot are deleted.
+//
+// A torn or corrupt record at the end of the log (for example, from a
+// crash in the middle of a write) is discarded when the log is opened.
+type Log struct {
+	mu   gosync.Mutex
+	dir  string
+	f    *os.File // current segment, or nil if the next append starts one
+	segs []int64  // first seqn of each segment, in order
+	snap int64    // seqn of the newest snapshot, or 0
+	last int64
+}
+
+// OpenLog opens the log in dir, creating dir if necessary.
+func OpenLog(dir string) (*Log, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir}
+	snaps, err := l.list(snapPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) > 0 {
+		l.snap = snaps[len(snaps)-1]
+		l.last = l.snap
+	}
+
+	l.segs, err = l.list(segPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.segs) == 0 {
+		return l, nil
+	}
+
+	name := l.name(segPrefix, l.segs[len(l.segs)-1])
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	off, last, err := scan(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last > l.last {
+		l.last = last
+	}
+
+	// Drop any partial record left at the end.
+	if err = f.Truncate(off); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Seek(off, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+func (l *Log) name(prefix string, seqn int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%020d", prefix, seqn))
+}
+
+// Returns the seqns of the files in l.dir named with prefix, in order.
+// Removes any temporary files left over from an interrupted snapshot.
+func (l *Log) list(prefix string) (seqns []int64, err error) {
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if strings.HasSuffix(name, tmpSuffix) {
+			os.Remove(filepath.Join(l.dir, name))
+			continue
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n, err := strconv.ParseInt(name[len(prefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+		seqns = append(seqns, n)
+	}
+	sort.Sort(int64s(seqns))
+	return seqns, nil
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// Reads every good record in r. Returns the offset just past the last
+// good record, and that record's seqn.
+func scan(r io.ReadSeeker) (off, last int64, err error) {
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		o, n, err := readRecord(br)
+		if err == io.EOF || err == ErrBadRecord {
+			return off, last, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		last = o.Seqn
+		off += int64(n)
+	}
+}
+
+// Last returns the seqn of the last operation recorded in l, or 0 if l is
+// empty.
+func (l *Log) Last() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// Recover rebuilds st from l. It loads the newest valid snapshot in l,
+// then replays the operations recorded after it, treating any gaps as
+// no-ops, as Flush does. It returns the seqn st is at afterward.
+//
+// St must be new, and l must not have been written to since it was
+// opened.
+func (l *Log) Recover(st *Store) (seqn int64, err error) {
+	snaps, err := l.list(snapPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var from int64
+	for i := len(snaps) - 1; i >= 0; i-- {
+		root, err := readSnapshot(l.name(snapPrefix, snaps[i]), snaps[i])
+		if err == ErrBadSnapshot {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		st.load(snaps[i], root)
+		from = snaps[i]
+		break
+	}
+
+	n, err := l.replay(st.Ops, from)
+	if err != nil {
+		return 0, err
+	}
+	if from > 0 || n > 0 {
+		st.Flush()
+	}
+	return <-st.Seqns, nil
+}
+
+// Sends every operation recorded in l after seqn on ops, in order. It
+// returns the number of operations sent.
+func (l *Log) replay(ops chan<- Op, seqn int64) (n int, err error) {
+	l.mu.Lock()
+	segs := append([]int64(nil), l.segs...)
+	l.mu.Unlock()
+
+	for i, first := range segs {
+		if i+1 < len(segs) && segs[i+1] <= seqn+1 {
+			continue // entirely covered
+		}
+
+		f, err := os.Open(l.name(segPrefix, first))
+		if err != nil {
+			return n, err
+		}
+
+		r := bufio.NewReader(f)
+		for {
+			o, _, err := readRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err == ErrBadRecord && i == len(segs)-1 {
+				break // torn write at the very end
+			}
+			if err != nil {
+				f.Close()
+				return n, err
+			}
+			if o.Seqn > seqn {
+				ops <- o
+				n++
+			}
+		}
+		f.Close()
+	}
+	return n, nil
+}
+
+// Snapshot writes a point-in-time snapshot of st to l, then deletes the
+// older snapshot and the segments of the log that the new one covers.
+func (l *Log) Snapshot(st *Store) error {
+	seqn, g := st.Snap()
+
+	l.mu.Lock()
+	done := seqn <= l.snap
+	l.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	name := l.name(snapPrefix, seqn)
+	err := writeSnapshot(name+tmpSuffix, seqn, g.(node))
+	if err != nil {
+		os.Remove(name + tmpSuffix)
+		return err
+	}
+	err = os.Rename(name+tmpSuffix, name)
+	if err != nil {
+		return err
+	}
+	err = l.syncDir()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old := l.snap
+	l.snap = seqn
+	if old > 0 {
+		os.Remove(l.name(snapPrefix, old))
+	}
+
+	// Start a new segment, so the current one can go once a snapshot
+	// covers it.
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+
+	var keep []int64
+	for i, first := range l.segs {
+		end := l.last
+		if i+1 < len(l.segs) {
+			end = l.segs[i+1] - 1
+		}
+		if end > seqn {
+			keep = append(keep, first)
+			continue
+		}
+		if err := os.Remove(l.name(segPrefix, first)); err != nil {
+			keep = append(keep, first)
+		}
+	}
+	l.segs = keep
+	return nil
+}
+
+// Reset discards everything recorded in l.
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+
+	for _, first := range l.segs {
+		if err := os.Remove(l.name(segPrefix, first)); err != nil {
+			return err
+		}
+	}
+	l.segs = nil
+
+	if l.snap > 0 {
+		if err := os.Remove(l.name(snapPrefix, l.snap)); err != nil {
+			return err
+		}
+	}
+	l.snap = 0
+	l.last = 0
+	return l.syncDir()
+}
+
+// Close closes the current segment.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *Log) syncDir() error {
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Appends o to l and syncs it to disk. Operations at or before the last
+// recorded seqn are already in the log and are silently ignored; this
+// happens while the log is being replayed into a store.
+func (l *Log) append(o Op) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if o.Seqn <= l.last {
+		return nil
+	}
+
+	if l.f == nil {
+		name := l.name(segPrefix, o.Seqn)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if err = l.syncDir(); err != nil {
+			f.Close()
+			return err
+		}
+		l.f = f
+		l.segs = append(l.segs, o.Seqn)
+	}
+
+	_, err := l.f.Write(encodeRecord(o))
+	if err != nil {
+		return err
+	}
+
+	err = l.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.last = o.Seqn
+	return nil
+}
+
+// A record is the seqn, the length of the mutation, and a CRC-32 of the
+// mutation, followed by the mutation itself.
+func encodeRecord(o Op) []byte {
+	b := make([]byte, recHeaderLen+len(o.Mut))
+	binary.BigEndian.PutUint64(b[0:8], uint64(o.Seqn))
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(o.Mut)))
+	copy(b[recHeaderLen:], o.Mut)
+	binary.BigEndian.PutUint32(b[12:16], crc32.ChecksumIEEE(b[recHeaderLen:]))
+	return b
+}
+
+func readRecord(r io.Reader) (o Op, n int, err error) {
+	var h [recHeaderLen]byte
+	_, err = io.ReadFull(r, h[:])
+	if err == io.ErrUnexpectedEOF {
+		return o, 0, ErrBadRecord
+	}
+	if err != nil {
+		return o, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(h[8:12])
+	if size > maxMutLen {
+		return o, 0, ErrBadRecord
+	}
+
+	mut := make([]byte, size)
+	_, err = io.ReadFull(r, mut)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return o, 0, ErrBadRecord
+	}
+	if err != nil {
+		return o, 0, err
+	}
+
+	if crc32.ChecksumIEEE(mut) != binary.BigEndian.Uint32(h[12:16]) {
+		return o, 0, ErrBadRecord
+	}
+
+	o.Seqn = int64(binary.BigEndian.Uint64(h[0:8]))
+	o.Mut = string(mut)
+	return o, recHeaderLen + len(mut), nil
+}
+
+// A snapshot is a sequence of records in the same format as the log. Each
+// holds a mutation that sets one file, with the file's rev in place of a
+// seqn, or, after all of those, the revs of one directory (see
+// dirRecPrefix), with its Created seqn in place of a seqn. The last record
+// is a Nop at the seqn of the snapshot; a snapshot without it is
+// incomplete.
+func writeSnapshot(name string, seqn int64, root node) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = root.each("", func(path, body string, rev int64) error {
+		mut, err := EncodeSet(path, body, Clobber)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(encodeRecord(Op{rev, mut}))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = root.eachDir("/", func(path string, d node) error {
+		mut := dirRecPrefix + strconv.FormatInt(d.Changed, 10) + ":" + path
+		_, err := w.Write(encodeRecord(Op{d.Created, mut}))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(encodeRecord(Op{seqn, Nop})); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readSnapshot(name string, seqn int64) (root node, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return node{}, err
+	}
+	defer f.Close()
+
+	root = node{V: "", Rev: Dir, Ds: make(map[string]node)}
+	r := bufio.NewReader(f)
+	for {
+		o, _, err := readRecord(r)
+		if err == io.EOF || err == ErrBadRecord {
+			return node{}, ErrBadSnapshot
+		}
+		if err != nil {
+			return node{}, err
+		}
+
+		if o.Mut == Nop {
+			if o.Seqn != seqn {
+				return node{}, ErrBadSnapshot
+			}
+			return root, nil
+		}
+
+		if strings.HasPrefix(o.Mut, dirRecPrefix) {
+			cp := strings.SplitN(o.Mut[len(dirRecPrefix):], ":", 2)
+			if len(cp) != 2 || checkPath(cp[1]) != nil {
+				return node{}, ErrBadSnapshot
+			}
+			changed, err := strconv.ParseInt(cp[0], 10, 64)
+			if err != nil {
+				return node{}, ErrBadSnapshot
+			}
+			root = root.setDirRevs(split(cp[1]), o.Seqn, changed)
+			continue
+		}
+
+		path, v, _, keep, err := decode(o.Mut)
+		if err != nil || !keep {
+			return node{}, ErrBadSnapshot
+		}
+		root = root.insert(split(path), v, o.Seqn)
+	}
+}
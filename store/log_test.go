@@ -0,0 +1,258 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempLog(t *testing.T) (*Log, string) {
+	dir, err := ioutil.TempDir("", "doozerd-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := OpenLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, dir
+}
+
+func replayAll(l *Log) (ops []Op, err error) {
+	ch := make(chan Op)
+	errs := make(chan error)
+	go func() {
+		_, err := l.replay(ch, 0)
+		close(ch)
+		errs <- err
+	}()
+	for o := range ch {
+		ops = append(ops, o)
+	}
+	return ops, <-errs
+}
+
+func TestLogAppendReplay(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	exp := []Op{
+		{1, MustEncodeSet("/x", "a", Clobber)},
+		{2, Nop},
+		{5, MustEncodeDel("/x", Clobber)},
+	}
+	for _, o := range exp {
+		assert.Equal(t, nil, l.append(o))
+	}
+	assert.Equal(t, nil, l.append(Op{2, Nop})) // already recorded
+	assert.Equal(t, int64(5), l.Last())
+
+	got, err := replayAll(l)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, exp, got)
+}
+
+func TestLogReopen(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	l.append(Op{1, Nop})
+	l.append(Op{2, Nop})
+	l.Close()
+
+	l, err := OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	assert.Equal(t, int64(2), l.Last())
+	l.append(Op{3, Nop})
+
+	got, err := replayAll(l)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Op{{1, Nop}, {2, Nop}, {3, Nop}}, got)
+}
+
+func TestLogTornRecord(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	l.append(Op{1, Nop})
+	l.append(Op{2, MustEncodeSet("/x", "a", Clobber)})
+	l.Close()
+
+	name := l.name(segPrefix, 1)
+	fi, err := os.Stat(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, os.Truncate(name, fi.Size()-1))
+
+	l, err = OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	assert.Equal(t, int64(1), l.Last())
+
+	l.append(Op{2, Nop})
+	got, err := replayAll(l)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Op{{1, Nop}, {2, Nop}}, got)
+}
+
+func TestLogReset(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+	l.append(Op{1, Nop})
+	assert.Equal(t, nil, l.Reset())
+	assert.Equal(t, int64(0), l.Last())
+
+	got, err := replayAll(l)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(got))
+}
+
+func TestStoreLoggedRecovers(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+
+	st := NewLogged(l)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/y/z", "b", Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/x", Clobber)}
+	sync(st, 3)
+	close(st.Ops)
+	l.Close()
+
+	l, err := OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+
+	st = NewLogged(l)
+	defer close(st.Ops)
+	seqn, err := l.Recover(st)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(3), seqn)
+
+	v, rev := st.Get("/y/z")
+	assert.Equal(t, []string{"b"}, v)
+	assert.Equal(t, int64(2), rev)
+	_, rev = st.Get("/x")
+	assert.Equal(t, Missing, rev)
+
+	// New mutations continue where the log left off.
+	st.Ops <- Op{4, MustEncodeSet("/x", "c", Clobber)}
+	sync(st, 4)
+	assert.Equal(t, int64(4), l.Last())
+}
+
+func TestLogSnapshot(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+
+	st := NewLogged(l)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/y/z", "b", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x", "c", Clobber)}
+	sync(st, 3)
+	assert.Equal(t, nil, l.Snapshot(st))
+
+	// The snapshot covers the only segment.
+	_, err := os.Stat(l.name(segPrefix, 1))
+	assert.T(t, os.IsNotExist(err))
+	_, err = os.Stat(l.name(snapPrefix, 3))
+	assert.Equal(t, nil, err)
+
+	st.Ops <- Op{4, MustEncodeDel("/y/z", Clobber)}
+	st.Ops <- Op{5, MustEncodeSet("/w", "d", Clobber)}
+	sync(st, 5)
+	close(st.Ops)
+	l.Close()
+
+	l, err = OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	assert.Equal(t, int64(5), l.Last())
+
+	st = NewLogged(l)
+	defer close(st.Ops)
+	seqn, err := l.Recover(st)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(5), seqn)
+
+	v, rev := st.Get("/x")
+	assert.Equal(t, []string{"c"}, v)
+	assert.Equal(t, int64(3), rev)
+	_, rev = st.Get("/y/z")
+	assert.Equal(t, Missing, rev)
+	v, rev = st.Get("/w")
+	assert.Equal(t, []string{"d"}, v)
+	assert.Equal(t, int64(5), rev)
+
+	// History before the snapshot is gone.
+	_, err = st.Wait(Any, 3)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestLogSnapshotNothingAfter(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+
+	st := NewLogged(l)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, Nop}
+	sync(st, 2)
+	assert.Equal(t, nil, l.Snapshot(st))
+	close(st.Ops)
+	l.Close()
+
+	l, err := OpenLog(dir)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	assert.Equal(t, int64(2), l.Last())
+
+	st = NewLogged(l)
+	defer close(st.Ops)
+	seqn, err := l.Recover(st)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2), seqn)
+	assert.Equal(t, "a", GetString(st, "/x"))
+}
+
+func TestReadSnapshotIncomplete(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	root, _ := emptyDir.apply(1, MustEncodeSet("/x/y", "a", Clobber))
+	name := l.name(snapPrefix, 1)
+	assert.Equal(t, nil, writeSnapshot(name, 1, root))
+
+	got, err := readSnapshot(name, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, root, got)
+
+	fi, err := os.Stat(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, os.Truncate(name, fi.Size()-1))
+	_, err = readSnapshot(name, 1)
+	assert.Equal(t, ErrBadSnapshot, err)
+}
+
+func TestSnapshotDirRevs(t *testing.T) {
+	l, dir := tempLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	root := mustApply(emptyDir,
+		MustEncodeSet("/a/b", "b", Clobber),
+		MustEncodeSet("/a/c/d", "d", Clobber),
+		MustEncodeDel("/a/b", Clobber),
+		MustEncodeSet("/x", "x", Clobber),
+	)
+	name := l.name(snapPrefix, 4)
+	assert.Equal(t, nil, writeSnapshot(name, 4, root))
+
+	got, err := readSnapshot(name, 4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, root, got)
+	created, changed := got.DirRevs("/a")
+	assert.Equal(t, int64(1), created)
+	assert.Equal(t, int64(3), changed)
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// A mutation in the binary form starts with binaryMark, which no mutation
+// in the legacy text form starts with, then the version of the binary
+// form it uses, then a mutation message encoded with protocol buffers.
+const (
+	binaryMark    = 0
+	binaryVersion = 1
+)
+
+var ErrMutationVersion = errors.New("unknown mutation version")
+
+// If TextMutations is true, EncodeSet, EncodeDel, EncodeDeltree, EncodeSeq
+// and EncodeMulti return mutations in the legacy text form instead of the
+// binary form. Nodes running older versions of doozerd can only apply the
+// text form, so it's for use while a cluster is being upgraded. It must be
+// set before any mutation is encoded.
+var TextMutations = false
+
+func encode(m *mutation) (string, error) {
+	if TextMutations {
+		return encodeText(m)
+	}
+
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string([]byte{binaryMark, binaryVersion}) + string(b), nil
+}
+
+func encodeText(m *mutation) (string, error) {
+	rev := strconv.FormatInt(m.GetRev(), 10)
+	switch m.GetOp() {
+	case mutation_SET:
+		return rev + ":" + m.GetPath() + "=" + string(m.Body), nil
+	case mutation_DEL:
+		return rev + ":" + m.GetPath(), nil
+	case mutation_DELTREE:
+		return deltreePrefix + rev + ":" + m.GetPath(), nil
+	case mutation_SEQ:
+		return seqPrefix + rev + ":" + m.GetPath() + "=" + string(m.Body), nil
+	case mutation_MULTI:
+		s := multiPrefix
+		for _, o := range m.Ops {
+			t, err := encodeText(o)
+			if err != nil {
+				return "", err
+			}
+			s += strconv.Itoa(len(t)) + ":" + t
+		}
+		return s, nil
+	}
+	return "", ErrBadMutation
+}
+
+// WithProposer returns mut, recording that node proposed it. Only the
+// binary form can record this; a mutation in the text form, or one that
+// can't be decoded, is returned as it is.
+func WithProposer(mut, node string) string {
+	if len(mut) == 0 || mut[0] != binaryMark {
+		return mut
+	}
+
+	m, err := decodeBinary(mut)
+	if err != nil {
+		return mut
+	}
+
+	m.Proposer = &node
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return mut
+	}
+	return mut[:2] + string(b)
+}
+
+// Returns mut in the text form, if it can be decoded, for people to read.
+func readable(mut string) string {
+	m, err := decodeMutation(mut)
+	if err != nil {
+		return mut
+	}
+
+	s, err := encodeText(m)
+	if err != nil {
+		return mut
+	}
+	return s
+}
+
+// Decodes a mutation in either form. The error is a *MultiError if the
+// mutation is a multi mutation and one of its operations is bad.
+func decodeMutation(mut string) (*mutation, error) {
+	if len(mut) > 0 && mut[0] == binaryMark {
+		return decodeBinary(mut)
+	}
+	return decodeText(mut)
+}
+
+func decodeBinary(mut string) (*mutation, error) {
+	if len(mut) < 2 {
+		return nil, ErrBadMutation
+	}
+
+	if mut[1] != binaryVersion {
+		return nil, ErrMutationVersion
+	}
+
+	m := new(mutation)
+	if err := proto.Unmarshal([]byte(mut[2:]), m); err != nil {
+		return nil, ErrBadMutation
+	}
+
+	switch m.GetOp() {
+	case mutation_SET, mutation_DEL, mutation_DELTREE, mutation_SEQ:
+		if err := checkOp(m); err != nil {
+			return nil, err
+		}
+	case mutation_MULTI:
+		if m.Path != nil || m.Body != nil || m.Rev != nil || len(m.Ops) == 0 {
+			return nil, ErrBadMutation
+		}
+		for i, o := range m.Ops {
+			err := checkOp(o)
+			if err == nil && o.Proposer != nil {
+				err = ErrBadMutation
+			}
+			if err == nil && (o.GetOp() == mutation_DELTREE || o.GetOp() == mutation_SEQ) {
+				err = ErrBadMutation
+			}
+			if err != nil {
+				return nil, &MultiError{i, o.GetPath(), err}
+			}
+		}
+	default:
+		return nil, ErrBadMutation
+	}
+	return m, nil
+}
+
+// Checks a decoded set, del, deltree or seq.
+func checkOp(m *mutation) error {
+	switch m.GetOp() {
+	case mutation_SET:
+	case mutation_DEL, mutation_DELTREE:
+		if m.Body != nil {
+			return ErrBadMutation
+		}
+	case mutation_SEQ:
+		if m.GetRev() != Missing || len(m.Ops) > 0 {
+			return ErrBadMutation
+		}
+		return checkSeqPrefix(m.GetPath())
+	default:
+		return ErrBadMutation
+	}
+
+	if m.Rev == nil || len(m.Ops) > 0 {
+		return ErrBadMutation
+	}
+	return checkPath(m.GetPath())
+}
+
+func decodeText(mut string) (*mutation, error) {
+	switch {
+	case strings.HasPrefix(mut, multiPrefix):
+		muts, err := decodeMulti(mut)
+		if err != nil {
+			return nil, err
+		}
+
+		m := &mutation{Op: mutation_MULTI.Enum()}
+		for i, s := range muts {
+			o, err := decodeTextOp(s)
+			if err != nil {
+				return nil, &MultiError{i, o.GetPath(), err}
+			}
+			m.Ops = append(m.Ops, o)
+		}
+		return m, nil
+	case strings.HasPrefix(mut, deltreePrefix):
+		m, err := decodeTextOp(mut[len(deltreePrefix):])
+		if err == nil && m.GetOp() != mutation_DEL {
+			err = ErrBadMutation
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Op = mutation_DELTREE.Enum()
+		return m, nil
+	case strings.HasPrefix(mut, seqPrefix):
+		// The prefix need not be a valid path by itself, so the error
+		// from decodeTextOp is only final if it returns no mutation.
+		m, err := decodeTextOp(mut[len(seqPrefix):])
+		if m == nil {
+			return nil, err
+		}
+		if m.GetOp() != mutation_SET {
+			return nil, ErrBadMutation
+		}
+		m.Op = mutation_SEQ.Enum()
+		if err = checkOp(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return decodeTextOp(mut)
+}
+
+// Decodes a set or del in the legacy text form, `rev:path=body` or
+// `rev:path`. Neither a rev nor a path can contain `:`, and a path can't
+// contain `=`, so the first of each marks the end of the rev and the path;
+// the body is everything after. Only the form encodeText produces is
+// accepted. If the path is bad, the mutation returned holds it, along with
+// the error.
+func decodeTextOp(mut string) (*mutation, error) {
+	cm := strings.SplitN(mut, ":", 2)
+
+	if len(cm) != 2 {
+		return nil, ErrBadMutation
+	}
+
+	rev, err := strconv.ParseInt(cm[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if strconv.FormatInt(rev, 10) != cm[0] {
+		return nil, ErrBadMutation
+	}
+
+	kv := strings.SplitN(cm[1], "=", 2)
+	m := &mutation{Op: mutation_DEL.Enum(), Path: &kv[0], Rev: &rev}
+	if len(kv) == 2 {
+		m.Op, m.Body = mutation_SET.Enum(), []byte(kv[1])
+	}
+
+	if err = checkPath(kv[0]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
@@ -0,0 +1,119 @@
+// Code generated by protoc-gen-go.
+// source: mut.proto
+// DO NOT EDIT!
+
+package store
+
+import proto "code.google.com/p/goprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type mutation_Op int32
+
+const (
+	mutation_SET     mutation_Op = 1
+	mutation_DEL     mutation_Op = 2
+	mutation_DELTREE mutation_Op = 3
+	mutation_MULTI   mutation_Op = 4
+	mutation_SEQ     mutation_Op = 5
+)
+
+var mutation_Op_name = map[int32]string{
+	1: "SET",
+	2: "DEL",
+	3: "DELTREE",
+	4: "MULTI",
+	5: "SEQ",
+}
+var mutation_Op_value = map[string]int32{
+	"SET":     1,
+	"DEL":     2,
+	"DELTREE": 3,
+	"MULTI":   4,
+	"SEQ":     5,
+}
+
+func (x mutation_Op) Enum() *mutation_Op {
+	p := new(mutation_Op)
+	*p = x
+	return p
+}
+func (x mutation_Op) String() string {
+	return proto.EnumName(mutation_Op_name, int32(x))
+}
+func (x mutation_Op) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *mutation_Op) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(mutation_Op_value, data, "mutation_Op")
+	if err != nil {
+		return err
+	}
+	*x = mutation_Op(value)
+	return nil
+}
+
+type mutation struct {
+	Op               *mutation_Op `protobuf:"varint,1,opt,name=op,enum=store.mutation_Op" json:"op,omitempty"`
+	Path             *string      `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Body             []byte       `protobuf:"bytes,3,opt,name=body" json:"body,omitempty"`
+	Rev              *int64       `protobuf:"varint,4,opt,name=rev" json:"rev,omitempty"`
+	Ops              []*mutation  `protobuf:"bytes,5,rep,name=ops" json:"ops,omitempty"`
+	Proposer         *string      `protobuf:"bytes,6,opt,name=proposer" json:"proposer,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (this *mutation) Reset()         { *this = mutation{} }
+func (this *mutation) String() string { return proto.CompactTextString(this) }
+func (*mutation) ProtoMessage()       {}
+
+func (this *mutation) GetOp() mutation_Op {
+	if this != nil && this.Op != nil {
+		return *this.Op
+	}
+	return 0
+}
+
+func (this *mutation) GetPath() string {
+	if this != nil && this.Path != nil {
+		return *this.Path
+	}
+	return ""
+}
+
+func (this *mutation) GetBody() []byte {
+	if this != nil {
+		return this.Body
+	}
+	return nil
+}
+
+func (this *mutation) GetRev() int64 {
+	if this != nil && this.Rev != nil {
+		return *this.Rev
+	}
+	return 0
+}
+
+func (this *mutation) GetOps() []*mutation {
+	if this != nil {
+		return this.Ops
+	}
+	return nil
+}
+
+func (this *mutation) GetProposer() string {
+	if this != nil && this.Proposer != nil {
+		return *this.Proposer
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterEnum("store.mutation_Op", mutation_Op_name, mutation_Op_value)
+}
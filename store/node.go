@@ -1,6 +1,8 @@
 package store
 
 import (
+	"sort"
+	"strings"
 	"syscall"
 )
 
@@ -10,11 +12,48 @@ const ErrorPath = "/ctl/err"
 
 const Nop = "nop:"
 
+// Mutations made by EncodeMulti, EncodeDeltree and EncodeSeq start with
+// these.
+const (
+	multiPrefix   = "multi:"
+	deltreePrefix = "deltree:"
+	seqPrefix     = "seq:"
+)
+
 // This structure should be kept immutable.
 type node struct {
 	V   string
 	Rev int64
 	Ds  map[string]node
+
+	// The number of files in the tree rooted here, and the number of bytes
+	// in their bodies and in the names of the files and directories under
+	// this one.
+	Keys  int64
+	Bytes int64
+
+	// For a directory, the seqn of the change that created it, and of the
+	// last change that added an entry to it or removed one. Both start at
+	// zero for the root.
+	Created int64
+	Changed int64
+}
+
+// Returns a file node holding v.
+func file(v string, rev int64) node {
+	return node{V: v, Rev: rev, Keys: 1, Bytes: int64(len(v))}
+}
+
+// Takes the totals of m, an entry called name, out of n's.
+func (n *node) sub(name string, m node) {
+	n.Keys -= m.Keys
+	n.Bytes -= m.Bytes + int64(len(name))
+}
+
+// Adds the totals of m, an entry called name, to n's.
+func (n *node) add(name string, m node) {
+	n.Keys += m.Keys
+	n.Bytes += m.Bytes + int64(len(name))
 }
 
 func (n node) String() string {
@@ -87,6 +126,41 @@ func (n node) Stat(path string) (int32, int64) {
 	return n.stat(split(path))
 }
 
+// Returns the number of files in the tree at path, and the number of bytes
+// in their bodies and in the names under path. Unless path is in /ctl,
+// nothing in /ctl is counted.
+func (n node) Usage(path string) (keys, bytes int64) {
+	if err := checkPath(path); err != nil {
+		return 0, 0
+	}
+
+	m, err := n.at(split(path))
+	if err != nil {
+		return 0, 0
+	}
+
+	if path == "/" {
+		if c, ok := m.Ds["ctl"]; ok {
+			m.sub("ctl", c)
+		}
+	}
+	return m.Keys, m.Bytes
+}
+
+// Returns the Created and Changed seqns of the directory at path, or
+// Missing and Missing if path is not a directory.
+func (n node) DirRevs(path string) (created, changed int64) {
+	if err := checkPath(path); err != nil {
+		return Missing, Missing
+	}
+
+	m, err := n.at(split(path))
+	if err != nil || m.Rev != Dir {
+		return Missing, Missing
+	}
+	return m.Created, m.Changed
+}
+
 func copyMap(a map[string]node) map[string]node {
 	b := make(map[string]node)
 	for k, v := range a {
@@ -95,32 +169,159 @@ func copyMap(a map[string]node) map[string]node {
 	return b
 }
 
-// Return value is replacement node
-func (n node) set(parts []string, v string, rev int64, keep bool) (node, bool) {
+// Return value is replacement node. Seqn is the seqn of the change, for
+// the directories it changes.
+func (n node) set(seqn int64, parts []string, v string, rev int64, keep bool) (node, bool) {
 	if len(parts) == 0 {
-		return node{v, rev, n.Ds}, keep
+		m := file(v, rev)
+		m.Ds = n.Ds
+		return m, keep
 	}
 
+	if n.Rev != Dir {
+		n.Created = seqn
+	}
+
+	name := parts[0]
 	n.Ds = copyMap(n.Ds)
-	p, ok := n.Ds[parts[0]].set(parts[1:], v, rev, keep)
+	m, had := n.Ds[name]
+	if had {
+		n.sub(name, m)
+	}
+	p, ok := m.set(seqn, parts[1:], v, rev, keep)
 	if ok {
-		n.Ds[parts[0]] = p
+		n.Ds[name] = p
+		n.add(name, p)
 	} else {
-		delete(n.Ds, parts[0])
+		delete(n.Ds, name)
+	}
+	if ok != had {
+		n.Changed = seqn
 	}
 	n.Rev = Dir
 	return n, len(n.Ds) > 0
 }
 
-func (n node) setp(k, v string, rev int64, keep bool) node {
+// Adds a file to a tree under construction, modifying n in place. Only
+// use this on a tree that no one else can see yet.
+//
+// Since the history of the tree is unknown, each directory is given the
+// lowest and highest revs of the files under it as its Created and Changed.
+func (n node) insert(parts []string, v string, rev int64) node {
+	if len(parts) == 0 {
+		return file(v, rev)
+	}
+
+	if n.Ds == nil {
+		n = node{V: "", Rev: Dir, Ds: make(map[string]node), Created: rev}
+	}
+	if rev < n.Created {
+		n.Created = rev
+	}
+	if rev > n.Changed {
+		n.Changed = rev
+	}
+	name := parts[0]
+	if m, ok := n.Ds[name]; ok {
+		n.sub(name, m)
+	}
+	m := n.Ds[name].insert(parts[1:], v, rev)
+	n.Ds[name] = m
+	n.add(name, m)
+	return n
+}
+
+// Sets the Created and Changed seqns of the directory at parts, if there
+// is one, in a tree under construction, modifying n in place, like insert.
+func (n node) setDirRevs(parts []string, created, changed int64) node {
+	if n.Rev != Dir {
+		return n
+	}
+
+	if len(parts) == 0 {
+		n.Created, n.Changed = created, changed
+		return n
+	}
+
+	if m, ok := n.Ds[parts[0]]; ok {
+		n.Ds[parts[0]] = m.setDirRevs(parts[1:], created, changed)
+	}
+	return n
+}
+
+// Calls f for each directory in the tree rooted at n, which is at path,
+// including n itself, in no particular order.
+func (n node) eachDir(path string, f func(path string, d node) error) error {
+	if n.Rev != Dir {
+		return nil
+	}
+
+	if err := f(path, n); err != nil {
+		return err
+	}
+
+	for name, m := range n.Ds {
+		if err := m.eachDir(strings.TrimRight(path, "/")+"/"+name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls f for each file in the tree rooted at n, in no particular order.
+func (n node) each(path string, f func(path, body string, rev int64) error) error {
+	if len(n.Ds) == 0 {
+		if n.Rev == Dir {
+			return nil // empty root
+		}
+		if path == "" {
+			path = "/"
+		}
+		return f(path, n.V, n.Rev)
+	}
+
+	for name, m := range n.Ds {
+		if err := m.each(path+"/"+name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n node) setp(seqn int64, k, v string, rev int64, keep bool) node {
 	if err := checkPath(k); err != nil {
 		return n
 	}
 
-	n, _ = n.set(split(k), v, rev, keep)
+	n, _ = n.set(seqn, split(k), v, rev, keep)
 	return n
 }
 
+// Returns the error, if any, that setting (if keep) or deleting the file at
+// path would cause, given rev.
+func (n node) check(path string, rev int64, keep bool) error {
+	if keep {
+		components := split(path)
+		for i := 0; i < len(components)-1; i++ {
+			_, dirRev := n.get(components[0 : i+1])
+			if dirRev == Missing {
+				break
+			}
+			if dirRev != Dir {
+				return syscall.ENOTDIR
+			}
+		}
+	}
+
+	_, curRev := n.Get(path)
+	if rev != Clobber && rev < curRev {
+		return ErrRevMismatch
+	} else if curRev == Dir {
+		return syscall.EISDIR
+	}
+	return nil
+}
+
 func (n node) apply(seqn int64, mut string) (rep node, ev Event) {
 	ev.Seqn, ev.Rev, ev.Mut = seqn, seqn, mut
 	if mut == Nop {
@@ -131,42 +332,130 @@ func (n node) apply(seqn int64, mut string) (rep node, ev Event) {
 		return
 	}
 
-	var rev int64
-	var keep bool
-	ev.Path, ev.Body, rev, keep, ev.Err = decode(mut)
+	m, err := decodeMutation(mut)
+	if err == nil {
+		switch m.GetOp() {
+		case mutation_MULTI:
+			return n.applyMulti(seqn, mut, m)
+		case mutation_DELTREE:
+			return n.applyDeltree(seqn, mut, m)
+		}
+	}
+
+	ev.Path, ev.Body, ev.Err = m.GetPath(), string(m.GetBody()), err
+	rev, keep := m.GetRev(), m.GetOp() == mutation_SET
+	if m.GetOp() == mutation_SEQ {
+		ev.Path, keep = SeqPath(ev.Path, seqn), true
+	}
 
-	if ev.Err == nil && keep {
-		components := split(ev.Path)
-		for i := 0; i < len(components)-1; i++ {
-			_, dirRev := n.get(components[0 : i+1])
-			if dirRev == Missing {
-				break
-			}
-			if dirRev != Dir {
-				ev.Err = syscall.ENOTDIR
-				break
-			}
+	if ev.Err == nil {
+		ev.Err = n.check(ev.Path, rev, keep)
+	}
+
+	if ev.Err == nil {
+		if !keep {
+			ev.Rev = Missing
+		}
+		rep = n.setp(seqn, ev.Path, ev.Body, ev.Rev, keep)
+		if keep {
+			ev.Err = checkQuotas(n, rep, []string{ev.Path})
+		}
+	}
+
+	if ev.Err != nil {
+		return n.journal(seqn, mut, m.GetProposer(), ev.Err)
+	}
+
+	ev.Getter = rep
+	return
+}
+
+// Applies every mutation in a multi mutation, or none of them. The event
+// has one change for each file changed.
+func (n node) applyMulti(seqn int64, mut string, m *mutation) (rep node, ev Event) {
+	ev.Seqn, ev.Path, ev.Rev, ev.Mut = seqn, "/", nop, mut
+
+	rep = n
+	for i, o := range m.Ops {
+		path, body, rev := o.GetPath(), string(o.Body), o.GetRev()
+		keep := o.GetOp() == mutation_SET
+		if err := rep.check(path, rev, keep); err != nil {
+			ev.Err = &MultiError{i, path, err}
+			break
+		}
+
+		c := Event{Seqn: seqn, Path: path, Body: body, Rev: seqn, Mut: mut}
+		if !keep {
+			c.Rev = Missing
 		}
+		rep = rep.setp(seqn, path, body, c.Rev, keep)
+		ev.Changes = append(ev.Changes, c)
 	}
 
 	if ev.Err == nil {
-		_, curRev := n.Get(ev.Path)
-		if rev != Clobber && rev < curRev {
-			ev.Err = ErrRevMismatch
-		} else if curRev == Dir {
-			ev.Err = syscall.EISDIR
+		paths := make([]string, len(ev.Changes))
+		for i, c := range ev.Changes {
+			paths[i] = c.Path
 		}
+		ev.Err = checkQuotas(n, rep, paths)
+	}
+
+	if ev.Err != nil {
+		return n.journal(seqn, mut, m.GetProposer(), ev.Err)
+	}
+
+	ev.Getter = rep
+	for i := range ev.Changes {
+		ev.Changes[i].Getter = rep
+	}
+	return
+}
+
+// Deletes the file or directory at the path in a deltree mutation, with
+// everything under it. The event has one change for each file deleted, in
+// order by path.
+func (n node) applyDeltree(seqn int64, mut string, m *mutation) (rep node, ev Event) {
+	ev.Seqn, ev.Path, ev.Rev, ev.Mut = seqn, m.GetPath(), Missing, mut
+	rev := m.GetRev()
+
+	t, err := n.at(split(ev.Path))
+	if err != nil {
+		t = emptyDir // nothing to delete
 	}
 
+	var paths []string
+	ev.Err = t.each(strings.TrimRight(ev.Path, "/"), func(path, _ string, r int64) error {
+		if rev != Clobber && rev < r {
+			return ErrRevMismatch
+		}
+		paths = append(paths, path)
+		return nil
+	})
+
 	if ev.Err != nil {
-		ev.Path, ev.Body, rev, keep = ErrorPath, ev.Err.Error(), Clobber, true
+		return n.journal(seqn, mut, m.GetProposer(), ev.Err)
+	}
+
+	// With no files to delete, this is just like a del of a missing file.
+	if len(paths) == 0 {
+		rep = n
+		ev.Getter = rep
+		return
 	}
 
-	if !keep {
-		ev.Rev = Missing
+	if ev.Path == "/" {
+		rep = emptyDir
+		rep.Created, rep.Changed = n.Created, seqn
+	} else {
+		rep = n.setp(seqn, ev.Path, "", Missing, false)
 	}
+	ev.Path, ev.Rev = "/", nop
 
-	rep = n.setp(ev.Path, ev.Body, ev.Rev, keep)
+	sort.Strings(paths)
+	for _, path := range paths {
+		c := Event{Seqn: seqn, Path: path, Rev: Missing, Mut: mut, Getter: rep}
+		ev.Changes = append(ev.Changes, c)
+	}
 	ev.Getter = rep
 	return
 }
@@ -6,24 +6,36 @@ import (
 	"testing"
 )
 
+// Returns a directory node holding ds, with its totals filled in.
+func dir(ds map[string]node) node {
+	n := node{V: "", Rev: Dir, Ds: ds}
+	for name, m := range ds {
+		n.add(name, m)
+	}
+	return n
+}
+
 func TestNodeApplySet(t *testing.T) {
 	k, v, seqn, rev := "x", "a", int64(1), int64(1)
 	p := "/" + k
 	m := MustEncodeSet(p, v, Clobber)
 	n, e := emptyDir.apply(seqn, m)
-	exp := node{"", Dir, map[string]node{k: {v, rev, nil}}}
+	exp := dir(map[string]node{k: file(v, rev)})
+	exp.Changed = seqn
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{seqn, p, v, rev, m, nil, n}, e)
+	assert.Equal(t, Event{seqn, p, v, rev, m, nil, nil, n}, e)
 }
 
 func TestNodeApplyDel(t *testing.T) {
 	k, seqn, rev := "x", int64(1), int64(1)
-	r := node{"", Dir, map[string]node{k: {"a", rev, nil}}}
+	r := dir(map[string]node{k: file("a", rev)})
 	p := "/" + k
 	m := MustEncodeDel(p, rev)
 	n, e := r.apply(seqn, m)
-	assert.Equal(t, emptyDir, n)
-	assert.Equal(t, Event{seqn, p, "", Missing, m, nil, n}, e)
+	exp := emptyDir
+	exp.Changed = seqn
+	assert.Equal(t, exp, n)
+	assert.Equal(t, Event{seqn, p, "", Missing, m, nil, nil, n}, e)
 }
 
 func TestNodeApplyNop(t *testing.T) {
@@ -31,30 +43,30 @@ func TestNodeApplyNop(t *testing.T) {
 	m := Nop
 	n, e := emptyDir.apply(seqn, m)
 	assert.Equal(t, emptyDir, n)
-	assert.Equal(t, Event{seqn, "/", "", nop, m, nil, n}, e)
+	assert.Equal(t, Event{seqn, "/", "", nop, m, nil, nil, n}, e)
 }
 
 func TestNodeApplyBadMutation(t *testing.T) {
-	seqn, rev := int64(1), int64(1)
+	seqn := int64(1)
 	m := BadMutations[0]
 	n, e := emptyDir.apply(seqn, m)
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {ErrBadMutation.Error(), rev, nil}}}}}
+	exp := journaled(emptyDir, seqn, m, ErrBadMutation)
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{seqn, ErrorPath, ErrBadMutation.Error(), rev, m, ErrBadMutation, n}, e)
+	assertJournaled(t, seqn, m, ErrBadMutation, n, e)
 }
 
 func TestNodeApplyBadInstruction(t *testing.T) {
-	seqn, rev := int64(1), int64(1)
+	seqn := int64(1)
 	m := "-1:x"
 	n, e := emptyDir.apply(seqn, m)
 	err := ErrBadPath
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {err.Error(), rev, nil}}}}}
+	exp := journaled(emptyDir, seqn, m, err)
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{seqn, ErrorPath, err.Error(), rev, m, err, n}, e)
+	assertJournaled(t, seqn, m, err, n, e)
 }
 
 func TestNodeApplyRevMismatch(t *testing.T) {
-	k, v, seqn, rev := "x", "a", int64(1), int64(1)
+	k, v, seqn := "x", "a", int64(1)
 	p := "/" + k
 
 	// -123 is less that the current rev, which is zero; and not Clobber.
@@ -62,9 +74,9 @@ func TestNodeApplyRevMismatch(t *testing.T) {
 	n, e := emptyDir.apply(seqn, m)
 
 	err := ErrRevMismatch
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {err.Error(), rev, nil}}}}}
+	exp := journaled(emptyDir, seqn, m, err)
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{seqn, ErrorPath, err.Error(), rev, m, err, n}, e)
+	assertJournaled(t, seqn, m, err, n, e)
 }
 
 func TestNodeNotADirectory(t *testing.T) {
@@ -72,9 +84,9 @@ func TestNodeNotADirectory(t *testing.T) {
 	m := MustEncodeSet("/x/y", "b", Clobber)
 	n, e := r.apply(2, m)
 	err := syscall.ENOTDIR
-	exp, _ := r.apply(2, MustEncodeSet("/ctl/err", err.Error(), Clobber))
+	exp := journaled(r, 2, m, err)
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{2, ErrorPath, err.Error(), 2, m, err, n}, e)
+	assertJournaled(t, 2, m, err, n, e)
 }
 
 func TestNodeNotADirectoryDeeper(t *testing.T) {
@@ -82,9 +94,9 @@ func TestNodeNotADirectoryDeeper(t *testing.T) {
 	m := MustEncodeSet("/x/y/z/w", "b", Clobber)
 	n, e := r.apply(2, m)
 	err := syscall.ENOTDIR
-	exp, _ := r.apply(2, MustEncodeSet("/ctl/err", err.Error(), Clobber))
+	exp := journaled(r, 2, m, err)
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{2, ErrorPath, err.Error(), 2, m, err, n}, e)
+	assertJournaled(t, 2, m, err, n, e)
 }
 
 func TestNodeIsADirectory(t *testing.T) {
@@ -92,7 +104,223 @@ func TestNodeIsADirectory(t *testing.T) {
 	m := MustEncodeSet("/x", "b", Clobber)
 	n, e := r.apply(2, m)
 	err := syscall.EISDIR
-	exp, _ := r.apply(2, MustEncodeSet("/ctl/err", err.Error(), Clobber))
+	exp := journaled(r, 2, m, err)
+	assert.Equal(t, exp, n)
+	assertJournaled(t, 2, m, err, n, e)
+}
+
+func TestNodeApplyMulti(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/queue/x", "job", Clobber))
+	m, err := EncodeMulti(
+		MustEncodeDel("/queue/x", 1),
+		MustEncodeSet("/running/x", "job", Missing),
+	)
+	assert.Equal(t, nil, err)
+
+	n, e := r.apply(2, m)
+	running := dir(map[string]node{"x": file("job", 2)})
+	running.Created, running.Changed = 2, 2
+	exp := dir(map[string]node{"running": running})
+	exp.Changed = 2
+	assert.Equal(t, exp, n)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, []Event{
+		{2, "/queue/x", "", Missing, m, nil, nil, n},
+		{2, "/running/x", "job", 2, m, nil, nil, n},
+	}, e.Changes)
+}
+
+func TestNodeApplyMultiRevMismatch(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/queue/x", "job", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/running/x", "other", Clobber))
+	m, err := EncodeMulti(
+		MustEncodeDel("/queue/x", 1),
+		MustEncodeSet("/running/x", "job", Missing),
+	)
+	assert.Equal(t, nil, err)
+
+	n, e := r.apply(3, m)
+	merr := &MultiError{1, "/running/x", ErrRevMismatch}
+	exp := journaled(r, 3, m, merr)
+	assert.Equal(t, exp, n)
+	assertJournaled(t, 3, m, merr, n, e)
+}
+
+func TestNodeApplyMultiSeesEarlierOps(t *testing.T) {
+	m, err := EncodeMulti(
+		MustEncodeSet("/x", "a", Missing),
+		MustEncodeSet("/x/y", "b", Clobber),
+	)
+	assert.Equal(t, nil, err)
+
+	n, e := emptyDir.apply(1, m)
+	merr := &MultiError{1, "/x/y", syscall.ENOTDIR}
+	assert.Equal(t, merr, e.Err)
+	exp := journaled(emptyDir, 1, m, merr)
+	assert.Equal(t, exp, n)
+}
+
+func TestNodeApplyMultiBadMutation(t *testing.T) {
+	for _, m := range []string{"multi:", "multi:x", "multi:5:-1:/", "multi:2:-1:/x=a"} {
+		_, e := emptyDir.apply(1, m)
+		assert.Equal(t, ErrBadMutation, e.Err, m)
+	}
+}
+
+func TestNodeApplyMultiBadBinary(t *testing.T) {
+	path, rev := "/x", Clobber
+	d := &mutation{Op: mutation_DELTREE.Enum(), Path: &path, Rev: &rev}
+	m, err := encode(&mutation{Op: mutation_MULTI.Enum(), Ops: []*mutation{d}})
+	assert.Equal(t, nil, err)
+
+	_, e := emptyDir.apply(1, m)
+	assert.Equal(t, &MultiError{0, "/x", ErrBadMutation}, e.Err)
+}
+
+// Mutations in the legacy text form, as older versions made them, apply
+// just as the same mutations in the binary form do.
+func TestNodeApplyText(t *testing.T) {
+	multi, err := EncodeMulti(
+		MustEncodeSet("/y", "b", Clobber),
+		MustEncodeDel("/x/a", 2),
+	)
+	assert.Equal(t, nil, err)
+
+	text := []string{
+		"-1:/x/a=a",
+		"-1:/x/b=b",
+		"multi:7:-1:/y=b6:2:/x/a",
+		"deltree:3:/x",
+		"0:/y",
+		"seq:0:/q/=j",
+	}
+	binary := []string{
+		MustEncodeSet("/x/a", "a", Clobber),
+		MustEncodeSet("/x/b", "b", Clobber),
+		multi,
+		MustEncodeDeltree("/x", 3),
+		MustEncodeDel("/y", Missing),
+		MustEncodeSeq("/q/", "j"),
+	}
+
+	n, m := emptyDir, emptyDir
+	for i := range text {
+		var e, f Event
+		n, e = n.apply(int64(i+1), text[i])
+		m, f = m.apply(int64(i+1), binary[i])
+		assert.Equal(t, m, n, text[i])
+		assert.Equal(t, f.Err, e.Err, text[i])
+		assert.Equal(t, f.Path, e.Path, text[i])
+		assert.Equal(t, len(f.Changes), len(e.Changes), text[i])
+	}
+}
+
+func TestNodeApplyDeltree(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x/b", "b", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/x/a/c", "c", Clobber))
+	r, _ = r.apply(3, MustEncodeSet("/y", "y", Clobber))
+	m := MustEncodeDeltree("/x", 3)
+
+	n, e := r.apply(4, m)
+	exp, _ := emptyDir.apply(3, MustEncodeSet("/y", "y", Clobber))
+	exp.Changed = 4
+	assert.Equal(t, exp, n)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, Event{4, "/", "", nop, m, nil, []Event{
+		{4, "/x/a/c", "", Missing, m, nil, nil, n},
+		{4, "/x/b", "", Missing, m, nil, nil, n},
+	}, n}, e)
+}
+
+func TestNodeApplyDeltreeRevMismatch(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x/a", "a", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/x/b", "b", Clobber))
+	m := MustEncodeDeltree("/x", 1)
+
+	n, e := r.apply(3, m)
+	exp := journaled(r, 3, m, ErrRevMismatch)
+	assert.Equal(t, exp, n)
+	assertJournaled(t, 3, m, ErrRevMismatch, n, e)
+}
+
+func TestNodeApplyDeltreeMissing(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m := MustEncodeDeltree("/x/y", Clobber)
+
+	n, e := r.apply(2, m)
+	assert.Equal(t, r, n)
+	assert.Equal(t, Event{2, "/x/y", "", Missing, m, nil, nil, n}, e)
+}
+
+func TestNodeApplyDeltreeRoot(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/y/z", "b", Clobber))
+
+	n, e := r.apply(3, MustEncodeDeltree("/", Clobber))
+	exp := emptyDir
+	exp.Changed = 3
+	assert.Equal(t, exp, n)
+	assert.Equal(t, 2, len(e.Changes))
+	assert.Equal(t, "/x", e.Changes[0].Path)
+	assert.Equal(t, "/y/z", e.Changes[1].Path)
+}
+
+func TestNodeApplySeq(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/q/job-0000000001", "a", Clobber))
+	m := MustEncodeSeq("/q/job-", "b")
+
+	n, e := r.apply(42, m)
+	exp, _ := r.apply(42, MustEncodeSet("/q/job-0000000042", "b", Clobber))
 	assert.Equal(t, exp, n)
-	assert.Equal(t, Event{2, ErrorPath, err.Error(), 2, m, err, n}, e)
+	assert.Equal(t, Event{42, "/q/job-0000000042", "b", 42, m, nil, nil, n}, e)
+}
+
+func TestNodeApplySeqExists(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/q/0000000002", "a", Clobber))
+	m := MustEncodeSeq("/q/", "b")
+
+	n, e := r.apply(2, m)
+	assert.Equal(t, journaled(r, 2, m, ErrRevMismatch), n)
+	assertJournaled(t, 2, m, ErrRevMismatch, n, e)
+}
+
+func TestNodeDirRevs(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/a/b", "b", Clobber), // 1
+		MustEncodeSet("/c", "c", Clobber),   // 2
+		MustEncodeSet("/a/b", "bb", 1),      // 3: changes no directory
+		MustEncodeSet("/a/d/e", "e", 0),     // 4
+		MustEncodeDel("/a/b", 3),            // 5
+	)
+
+	created, changed := n.DirRevs("/")
+	assert.Equal(t, int64(0), created)
+	assert.Equal(t, int64(2), changed)
+
+	created, changed = n.DirRevs("/a")
+	assert.Equal(t, int64(1), created)
+	assert.Equal(t, int64(5), changed)
+
+	created, changed = n.DirRevs("/a/d")
+	assert.Equal(t, int64(4), created)
+	assert.Equal(t, int64(4), changed)
+
+	created, changed = n.DirRevs("/c")
+	assert.Equal(t, Missing, created)
+	assert.Equal(t, Missing, changed)
+
+	created, changed = n.DirRevs("/x")
+	assert.Equal(t, Missing, created)
+	assert.Equal(t, Missing, changed)
+}
+
+func TestNodeDirRevsRecreated(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/a/b", "b", Clobber),
+		MustEncodeDel("/a/b", Clobber),
+		MustEncodeSet("/a/c", "c", Clobber),
+	)
+	created, changed := n.DirRevs("/a")
+	assert.Equal(t, int64(3), created)
+	assert.Equal(t, int64(3), changed)
 }
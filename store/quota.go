@@ -0,0 +1,92 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Quotas live in directories under QuotaDir, one for each quota. In each,
+// file path holds the path of the subtree the quota is for, and files keys
+// and bytes, if present, hold the most files and bytes (as counted by
+// Usage) the subtree may hold. The name of the directory doesn't matter.
+//
+// A change that leaves a subtree over one of its quotas fails, unless the
+// subtree has not grown, so a subtree already over a quota (because the
+// quota has been lowered) can still shrink. Changes to files in /ctl are
+// not limited by quotas.
+const QuotaDir = "/ctl/quota"
+
+// A LimitError records a limit that a change would go over.
+type LimitError struct {
+	Path  string // the subtree, or file, the limit is for
+	Limit string // which limit: "keys", "bytes", "value" or "depth"
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded for %s", e.Limit, e.Max, e.Path)
+}
+
+var quotaLimits = []string{"keys", "bytes"}
+
+// Returns an error if the change that turned n into rep, which changed the
+// files at paths, leaves a subtree over one of the quotas in force in n.
+func checkQuotas(n, rep node, paths []string) error {
+	var changed []string
+	for _, p := range paths {
+		if !under(p, "/ctl") {
+			changed = append(changed, p)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	names, rev := n.Get(QuotaDir)
+	if rev != Dir {
+		return nil
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		dir := QuotaDir + "/" + name
+		path := GetString(n, dir+"/path")
+		if checkPath(path) != nil || !anyUnder(changed, path) {
+			continue
+		}
+
+		oldKeys, oldBytes := n.Usage(path)
+		keys, bytes := rep.Usage(path)
+		for _, limit := range quotaLimits {
+			max, err := strconv.ParseInt(GetString(n, dir+"/"+limit), 10, 64)
+			if err != nil || max < 0 {
+				continue
+			}
+
+			used, old := keys, oldKeys
+			if limit == "bytes" {
+				used, old = bytes, oldBytes
+			}
+			if used > max && used > old {
+				return &LimitError{path, limit, max}
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether path is dir or is in the tree under it.
+func under(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func anyUnder(paths []string, dir string) bool {
+	for _, p := range paths {
+		if under(p, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func mustApply(n node, muts ...string) node {
+	for i, m := range muts {
+		var e Event
+		n, e = n.apply(int64(i+1), m)
+		if e.Err != nil {
+			panic(e.Err)
+		}
+	}
+	return n
+}
+
+func TestNodeUsage(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/a/b", "xy", Clobber),
+		MustEncodeSet("/a/c", "z", Clobber),
+		MustEncodeSet("/ctl/x", "q", Clobber),
+	)
+
+	keys, bytes := n.Usage("/a")
+	assert.Equal(t, int64(2), keys)
+	assert.Equal(t, int64(len("xy")+len("z")+len("b")+len("c")), bytes)
+
+	keys, bytes = n.Usage("/")
+	assert.Equal(t, int64(2), keys)
+	assert.Equal(t, int64(len("xy")+len("z")+len("b")+len("c")+len("a")), bytes)
+
+	keys, bytes = n.Usage("/ctl")
+	assert.Equal(t, int64(1), keys)
+	assert.Equal(t, int64(len("q")+len("x")), bytes)
+
+	keys, bytes = n.Usage("/a/b")
+	assert.Equal(t, int64(1), keys)
+	assert.Equal(t, int64(len("xy")), bytes)
+
+	keys, bytes = n.Usage("/nothing")
+	assert.Equal(t, int64(0), keys)
+	assert.Equal(t, int64(0), bytes)
+
+	n = mustApply(n, MustEncodeDeltree("/a", Clobber))
+	keys, bytes = n.Usage("/")
+	assert.Equal(t, int64(0), keys)
+	assert.Equal(t, int64(0), bytes)
+}
+
+func TestNodeInsertUsage(t *testing.T) {
+	exp := mustApply(emptyDir,
+		MustEncodeSet("/a/b", "xy", Clobber),
+		MustEncodeSet("/a/c", "z", Clobber),
+	)
+
+	n := node{V: "", Rev: Dir, Ds: make(map[string]node)}
+	n = n.insert(split("/a/b"), "xy", 1)
+	n = n.insert(split("/a/c"), "z", 2)
+	exp.Changed = 2 // insert gives a directory the newest rev under it
+	assert.Equal(t, exp, n)
+}
+
+func TestQuotaKeys(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/ctl/quota/app/path", "/app", Clobber),
+		MustEncodeSet("/ctl/quota/app/keys", "2", Clobber),
+		MustEncodeSet("/app/a", "a", Clobber),
+		MustEncodeSet("/app/b", "b", Clobber),
+	)
+
+	_, e := n.apply(5, MustEncodeSet("/app/c", "c", Clobber))
+	assert.Equal(t, &LimitError{"/app", "keys", 2}, e.Err)
+	assert.Equal(t, e.Err.Error(), GetString(e.Getter, "/ctl/err/5/err"))
+
+	_, e = n.apply(5, MustEncodeSet("/app/a", "aa", Clobber))
+	assert.Equal(t, nil, e.Err)
+
+	_, e = n.apply(5, MustEncodeSet("/other/c", "c", Clobber))
+	assert.Equal(t, nil, e.Err)
+}
+
+func TestQuotaBytesLowered(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/app/a", "abcdef", Clobber),
+		MustEncodeSet("/ctl/quota/q/path", "/app", Clobber),
+		MustEncodeSet("/ctl/quota/q/bytes", "4", Clobber),
+	)
+
+	_, e := n.apply(4, MustEncodeSet("/app/a", "abcdefg", Clobber))
+	assert.Equal(t, &LimitError{"/app", "bytes", 4}, e.Err)
+
+	_, e = n.apply(4, MustEncodeSet("/app/a", "abc", Clobber))
+	assert.Equal(t, nil, e.Err)
+}
+
+func TestQuotaMulti(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/ctl/quota/q/path", "/queue", Clobber),
+		MustEncodeSet("/ctl/quota/q/keys", "1", Clobber),
+		MustEncodeSet("/queue/x", "job", Clobber),
+	)
+
+	m, err := EncodeMulti(
+		MustEncodeDel("/queue/x", Clobber),
+		MustEncodeSet("/queue/y", "job", Clobber),
+	)
+	assert.Equal(t, nil, err)
+	_, e := n.apply(4, m)
+	assert.Equal(t, nil, e.Err)
+
+	m, err = EncodeMulti(
+		MustEncodeSet("/queue/y", "job", Clobber),
+		MustEncodeSet("/queue/z", "job", Clobber),
+	)
+	assert.Equal(t, nil, err)
+	r, e := n.apply(4, m)
+	assert.Equal(t, &LimitError{"/queue", "keys", 1}, e.Err)
+	assert.Equal(t, []string{"job"}, get(r, "/queue/x"))
+	assert.Equal(t, Missing, rev(r, "/queue/y"))
+}
+
+func TestQuotaRootSparesCtl(t *testing.T) {
+	n := mustApply(emptyDir,
+		MustEncodeSet("/ctl/quota/all/path", "/", Clobber),
+		MustEncodeSet("/ctl/quota/all/keys", "0", Clobber),
+	)
+
+	_, e := n.apply(3, MustEncodeSet("/ctl/node/a/x", "1", Clobber))
+	assert.Equal(t, nil, e.Err)
+
+	_, e = n.apply(3, MustEncodeSet("/x", "1", Clobber))
+	assert.Equal(t, &LimitError{"/", "keys", 0}, e.Err)
+}
+
+func get(n node, path string) []string {
+	v, _ := n.Get(path)
+	return v
+}
+
+func rev(n node, path string) int64 {
+	_, r := n.Get(path)
+	return r
+}
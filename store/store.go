@@ -2,10 +2,12 @@ package store
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Special values for a revision.
@@ -16,8 +18,11 @@ const (
 	nop
 )
 
-// TODO revisit this when package regexp is more complete (e.g. do Unicode)
-const charPat = `[a-zA-Z0-9.\-]`
+// The chars a name in a path can be made of: Unicode letters, marks and
+// numbers, `.`, `-` and `_`. None of the chars that delimit the parts of a
+// mutation (`:` and `=`) or that have a meaning in a glob pattern is among
+// them, so a valid path never needs quoting in either.
+const charPat = `[\pL\pM\pN._\-]`
 
 var pathRe = mustBuildRe(charPat)
 
@@ -25,31 +30,57 @@ var Any = MustCompileGlob("/**")
 
 var ErrTooLate = errors.New("too late")
 
+// ErrNoRev is returned for a rev that is less than 1, or later than the
+// current rev, where a rev that exists now is needed.
+var ErrNoRev = errors.New("no such rev")
+
+// ErrClosed is returned when the store is closed before an answer is
+// ready.
+var ErrClosed = errors.New("store closed")
+
 var (
 	ErrBadMutation = errors.New("bad mutation")
 	ErrRevMismatch = errors.New("rev mismatch")
 	ErrBadPath     = errors.New("bad path")
 )
 
+// MultiError records which operation in a mutation made by EncodeMulti
+// failed, causing none of them to be applied.
+type MultiError struct {
+	Index int    // position of the failed operation
+	Path  string // path the failed operation refers to
+	Err   error
+}
+
+func (e *MultiError) Error() string {
+	return fmt.Sprintf("op %d (%s): %v", e.Index, e.Path, e.Err)
+}
+
 func mustBuildRe(p string) *regexp.Regexp {
 	return regexp.MustCompile(`^/$|^(/` + p + `+)+$`)
 }
 
 // Applies mutations sent on Ops in sequence according to field Seqn. Any
-// errors that occur will be written to ErrorPath. Duplicate operations at a
-// given position are sliently ignored.
+// mutation that can't be applied is recorded in the journal under
+// ErrorPath (see MaxErrors). Duplicate operations at a given position are
+// sliently ignored.
 type Store struct {
 	Ops     chan<- Op
 	Seqns   <-chan int64
 	Waiting <-chan int
 	watchCh chan *watch
-	watches []*watch
+	unwatch chan unwaitReq
+	watches watchIndex
 	todo    []Op
 	state   *state
 	head    int64
 	log     map[int64]Event
 	cleanCh chan int64
 	flush   chan bool
+	loadCh  chan *state
+	histCh  chan *histReq
+	done    chan bool // closed when the store is closed
+	wal     *Log
 }
 
 // Represents an operation to apply to the store at position Seqn.
@@ -68,13 +99,31 @@ type state struct {
 type watch struct {
 	glob *Glob
 	rev  int64
-	c    chan<- Event
+	c    chan Event
+	all  bool // send the whole event, not just the matching change
+	skip int  // matching changes at rev to pass over; see WaitSkip
+
+	fired bool // see watchIndex.notify
+}
+
+// Returns how many matching changes w passes over at seqn.
+func (w *watch) skipAt(seqn int64) int {
+	if seqn == w.rev {
+		return w.skip
+	}
+	return 0
 }
 
 // Creates a new, empty data store. Mutations will be applied in order,
 // starting at number 1 (number 0 can be thought of as the creation of the
 // store).
 func New() *Store {
+	return NewLogged(nil)
+}
+
+// NewLogged is like New, but each mutation is recorded in l, and synced to
+// disk, before it is applied. If l is nil, nothing is recorded.
+func NewLogged(l *Log) *Store {
 	ops := make(chan Op)
 	seqns := make(chan int64)
 	watches := make(chan int)
@@ -84,11 +133,15 @@ func New() *Store {
 		Seqns:   seqns,
 		Waiting: watches,
 		watchCh: make(chan *watch),
-		watches: []*watch{},
+		unwatch: make(chan unwaitReq),
 		state:   &state{0, emptyDir},
 		log:     map[int64]Event{},
 		cleanCh: make(chan int64),
 		flush:   make(chan bool),
+		loadCh:  make(chan *state),
+		histCh:  make(chan *histReq),
+		done:    make(chan bool),
+		wal:     l,
 	}
 
 	go st.process(ops, seqns, watches)
@@ -107,21 +160,31 @@ func join(parts []string) string {
 }
 
 func checkPath(k string) error {
-	if !pathRe.MatchString(k) {
+	if !utf8.ValidString(k) || !pathRe.MatchString(k) {
 		return ErrBadPath
 	}
 	return nil
 }
 
+// CheckPath returns ErrBadPath if path is not a valid path.
+func CheckPath(path string) error {
+	return checkPath(path)
+}
+
 // Returns a mutation that can be applied to a `Store`. The mutation will set
 // the contents of the file at `path` to `body` iff `rev` is greater than
 // of equal to the file's revision at the time of application, with
 // one exception: if `rev` is Clobber, the file will be set unconditionally.
-func EncodeSet(path, body string, rev int64) (mutation string, err error) {
+func EncodeSet(path, body string, rev int64) (mut string, err error) {
 	if err = checkPath(path); err != nil {
 		return
 	}
-	return strconv.FormatInt(rev, 10) + ":" + path + "=" + body, nil
+	return encode(&mutation{
+		Op:   mutation_SET.Enum(),
+		Path: &path,
+		Body: []byte(body),
+		Rev:  &rev,
+	})
 }
 
 // Returns a mutation that can be applied to a `Store`. The mutation will cause
@@ -129,11 +192,78 @@ func EncodeSet(path, body string, rev int64) (mutation string, err error) {
 // of equal to the file's revision at the time of application, with
 // one exception: if `rev` is Clobber, the file will be deleted
 // unconditionally.
-func EncodeDel(path string, rev int64) (mutation string, err error) {
+func EncodeDel(path string, rev int64) (mut string, err error) {
 	if err = checkPath(path); err != nil {
 		return
 	}
-	return strconv.FormatInt(rev, 10) + ":" + path, nil
+	return encode(&mutation{Op: mutation_DEL.Enum(), Path: &path, Rev: &rev})
+}
+
+// Returns a mutation that can be applied to a `Store`. The mutation will
+// delete the file or directory at `path`, and everything under it, iff
+// `rev` is greater than or equal to the revision of every file it would
+// delete, with one exception: if `rev` is Clobber, everything will be
+// deleted unconditionally.
+func EncodeDeltree(path string, rev int64) (mut string, err error) {
+	if err = checkPath(path); err != nil {
+		return
+	}
+	return encode(&mutation{Op: mutation_DELTREE.Enum(), Path: &path, Rev: &rev})
+}
+
+// Returns a mutation that can be applied to a `Store`. The mutation will
+// create a new file, named `prefix` followed by the seqn it is applied at
+// (see SeqPath), holding `body`. The path of the new file is in the event.
+// If a file already has that path, the mutation fails with
+// ErrRevMismatch. Unlike the paths of other mutations, `prefix` may end
+// in a slash, so that the name of the new file is just the seqn.
+func EncodeSeq(prefix, body string) (mut string, err error) {
+	if err = checkSeqPrefix(prefix); err != nil {
+		return
+	}
+	rev := Missing
+	return encode(&mutation{
+		Op:   mutation_SEQ.Enum(),
+		Path: &prefix,
+		Body: []byte(body),
+		Rev:  &rev,
+	})
+}
+
+// SeqPath returns the path of the file a mutation made by EncodeSeq with
+// `prefix` creates, if applied at `seqn`: the prefix followed by the seqn
+// in decimal, padded with zeros to at least ten digits so that the paths
+// sort in order.
+func SeqPath(prefix string, seqn int64) string {
+	return fmt.Sprintf("%s%010d", prefix, seqn)
+}
+
+func checkSeqPrefix(prefix string) error {
+	return checkPath(SeqPath(prefix, 0))
+}
+
+// Returns a mutation that can be applied to a `Store`. The mutation will
+// apply each of `muts`, in order, as a single change. Each of `muts` must be
+// a mutation returned by EncodeSet or EncodeDel, in either form. If any one
+// of them would fail, none of them is applied, and the error is a
+// *MultiError.
+func EncodeMulti(muts ...string) (mut string, err error) {
+	if len(muts) == 0 {
+		return "", ErrBadMutation
+	}
+
+	m := &mutation{Op: mutation_MULTI.Enum()}
+	for _, s := range muts {
+		o, err := decodeMutation(s)
+		if err != nil {
+			return "", err
+		}
+		if op := o.GetOp(); op != mutation_SET && op != mutation_DEL {
+			return "", ErrBadMutation
+		}
+		m.Ops = append(m.Ops, o)
+	}
+	return encode(m)
 }
 
 // MustEncodeSet is like EncodeSet but panics if the mutation cannot be
@@ -158,38 +288,76 @@ func MustEncodeDel(path string, rev int64) (mutation string) {
 	return m
 }
 
-func decode(mutation string) (path, v string, rev int64, keep bool, err error) {
-	cm := strings.SplitN(mutation, ":", 2)
+// MustEncodeSeq is like EncodeSeq but panics if the mutation cannot be
+// encoded.
+func MustEncodeSeq(prefix, body string) (mutation string) {
+	m, err := EncodeSeq(prefix, body)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
 
-	if len(cm) != 2 {
-		err = ErrBadMutation
-		return
+// MustEncodeDeltree is like EncodeDeltree but panics if the mutation
+// cannot be encoded.
+func MustEncodeDeltree(path string, rev int64) (mutation string) {
+	m, err := EncodeDeltree(path, rev)
+	if err != nil {
+		panic(err)
 	}
+	return m
+}
 
-	rev, err = strconv.ParseInt(cm[0], 10, 64)
+// Decodes a mutation made by EncodeSet or EncodeDel, in either form.
+func decode(mut string) (path, v string, rev int64, keep bool, err error) {
+	m, err := decodeMutation(mut)
+	if m != nil {
+		path, v, rev = m.GetPath(), string(m.Body), m.GetRev()
+	}
 	if err != nil {
 		return
 	}
 
-	kv := strings.SplitN(cm[1], "=", 2)
+	switch m.GetOp() {
+	case mutation_SET:
+		keep = true
+	case mutation_DEL:
+	default:
+		err = ErrBadMutation
+	}
+	return
+}
 
-	if err = checkPath(kv[0]); err != nil {
-		return
+func decodeMulti(mutation string) (muts []string, err error) {
+	s := mutation[len(multiPrefix):]
+	for len(s) > 0 {
+		i := strings.Index(s, ":")
+		if i < 0 {
+			return nil, ErrBadMutation
+		}
+
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 || n > len(s)-i-1 {
+			return nil, ErrBadMutation
+		}
+
+		muts = append(muts, s[i+1:i+1+n])
+		s = s[i+1+n:]
 	}
 
-	switch len(kv) {
-	case 1:
-		return kv[0], "", rev, false, nil
-	case 2:
-		return kv[0], kv[1], rev, true, nil
+	if len(muts) == 0 {
+		return nil, ErrBadMutation
 	}
-	panic("unreachable")
+	return muts, nil
 }
 
 func (st *Store) notify(e Event, ws []*watch) (nws []*watch) {
 	for _, w := range ws {
-		if e.Seqn >= w.rev && w.glob.Match(e.Path) {
-			w.c <- e
+		if m, ok := e.match(w.glob, w.skipAt(e.Seqn)); e.Seqn >= w.rev && ok {
+			if w.all {
+				m = e
+			}
+			w.c <- m
 		} else {
 			nws = append(nws, w)
 		}
@@ -199,12 +367,13 @@ func (st *Store) notify(e Event, ws []*watch) (nws []*watch) {
 }
 
 func (st *Store) closeWatches() {
-	for _, w := range st.watches {
+	st.watches.each(func(w *watch) {
 		close(w.c)
-	}
+	})
 }
 
 func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int) {
+	defer close(st.done)
 	defer st.closeWatches()
 
 	for {
@@ -230,17 +399,32 @@ func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int)
 				ws = st.notify(st.log[n], ws)
 			}
 
-			st.watches = append(st.watches, ws...)
+			for _, w := range ws {
+				st.watches.add(w)
+			}
+		case u := <-st.unwatch:
+			if w := st.watches.find(u.glob, u.c); w != nil {
+				st.watches.remove(w)
+				close(w.c)
+			}
 		case seqn := <-st.cleanCh:
 			for ; st.head <= seqn; st.head++ {
 				delete(st.log, st.head)
 			}
 		case seqns <- ver:
 			// nothing to do here
-		case watches <- len(st.watches):
+		case watches <- st.watches.n:
 			// nothing to do here
 		case flush = <-st.flush:
 			// nothing
+		case h := <-st.histCh:
+			h.c <- st.history(h, ver)
+		case s := <-st.loadCh:
+			if s.ver > ver {
+				st.state = s
+				ver, values = s.ver, s.root
+				st.head = ver + 1
+			}
 		}
 
 		var ev Event
@@ -260,19 +444,25 @@ func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int)
 				continue
 			}
 
+			if st.wal != nil {
+				if err := st.wal.append(t); err != nil {
+					panic(err)
+				}
+			}
+
 			values, ev = values.apply(t.Seqn, t.Mut)
 			st.state = &state{ev.Seqn, values}
 			ver = ev.Seqn
 			if !flush {
 				st.log[ev.Seqn] = ev
-				st.watches = st.notify(ev, st.watches)
+				st.watches.notify(ev)
 			}
 		}
 
 		// A flush just gets one final event.
 		if flush {
 			st.log[ev.Seqn] = ev
-			st.watches = st.notify(ev, st.watches)
+			st.watches.notify(ev)
 			st.head = ver + 1
 		}
 	}
@@ -318,6 +508,16 @@ func (st *Store) Stat(path string) (int32, int64) {
 	return g.Stat(path)
 }
 
+func (st *Store) Usage(path string) (keys, bytes int64) {
+	_, g := st.Snap()
+	return g.Usage(path)
+}
+
+func (st *Store) DirRevs(path string) (created, changed int64) {
+	_, g := st.Snap()
+	return g.DirRevs(path)
+}
+
 // Apply all operations in the internal queue, even if there are gaps in the
 // sequence (gaps will be treated as no-ops). This is only useful for
 // bootstrapping a store from a point-in-time snapshot of another store.
@@ -325,14 +525,33 @@ func (st *Store) Flush() {
 	st.flush <- true
 }
 
+// Replaces the contents of the store with root, as of seqn. Like Flush,
+// this is only useful for bootstrapping a new store.
+func (st *Store) load(seqn int64, root node) {
+	st.loadCh <- &state{seqn, root}
+}
+
 // Returns a chan that will receive a single event representing the
 // first change made to any file matching glob on or after rev.
 //
 // If rev is less than any value passed to st.Clean, Wait will return
 // ErrTooLate.
 func (st *Store) Wait(glob *Glob, rev int64) (<-chan Event, error) {
+	return st.wait(glob, rev, 0, false)
+}
+
+// WaitSkip is like Wait, but passes over the first skip changes to
+// matching files made at rev itself. A single mutation, such as a
+// Deltree, can change several files at one rev; after getting n of them,
+// with Wait or WaitSkip, WaitSkip(glob, rev, n) gets the next, or, if
+// there are no more, the first change after rev.
+func (st *Store) WaitSkip(glob *Glob, rev int64, skip int) (<-chan Event, error) {
+	return st.wait(glob, rev, skip, false)
+}
+
+func (st *Store) wait(glob *Glob, rev int64, skip int, all bool) (<-chan Event, error) {
 	if rev < 1 {
-		rev = 1
+		rev, skip = 1, 0
 	}
 
 	ch := make(chan Event, 1)
@@ -340,6 +559,8 @@ func (st *Store) Wait(glob *Glob, rev int64) (<-chan Event, error) {
 		glob: glob,
 		rev:  rev,
 		c:    ch,
+		all:  all,
+		skip: skip,
 	}
 	st.watchCh <- wt
 
@@ -349,6 +570,83 @@ func (st *Store) Wait(glob *Glob, rev int64) (<-chan Event, error) {
 	return ch, nil
 }
 
+// Unregisters a wait made with Wait, using the same glob and the chan it
+// returned. If ch has not yet received its event, it never will, and it
+// is closed. This frees the resources held by a wait that is no longer
+// wanted.
+func (st *Store) Unwait(glob *Glob, ch <-chan Event) {
+	select {
+	case st.unwatch <- unwaitReq{glob, ch}:
+	case <-st.done:
+	}
+}
+
+type unwaitReq struct {
+	glob *Glob
+	c    <-chan Event
+}
+
+type histReq struct {
+	glob     *Glob
+	from, to int64
+	limit    int
+	c        chan histResp
+}
+
+type histResp struct {
+	evs  []Event
+	next int64
+	err  error
+}
+
+// Returns the sets and deletes of files matching glob, in order, made in
+// revs from through to, inclusive. If to is 0 or later than the current
+// rev, it means the current rev.
+//
+// At most limit events are returned, except that all of the changes made
+// in a single rev are returned together. If there are more to come, next
+// is the rev to ask for them from; otherwise, it is 0.
+//
+// If from is less than any value passed to st.Clean, History will return
+// ErrTooLate. If the store is closed, it returns ErrClosed.
+func (st *Store) History(glob *Glob, from, to int64, limit int) (evs []Event, next int64, err error) {
+	h := &histReq{glob, from, to, limit, make(chan histResp, 1)}
+	select {
+	case st.histCh <- h:
+	case <-st.done:
+		return nil, 0, ErrClosed
+	}
+	r := <-h.c
+	return r.evs, r.next, r.err
+}
+
+func (st *Store) history(h *histReq, ver int64) (r histResp) {
+	if h.from < 1 {
+		h.from = 1
+	}
+	if h.from < st.head {
+		r.err = ErrTooLate
+		return
+	}
+	if h.to == 0 || h.to > ver {
+		h.to = ver
+	}
+
+	for n := h.from; n <= h.to; n++ {
+		if len(r.evs) >= h.limit {
+			r.next = n
+			break
+		}
+
+		for _, ev := range st.log[n].matches(h.glob) {
+			if ev.IsSet() || ev.IsDel() {
+				r.evs = append(r.evs, ev)
+			}
+		}
+	}
+	return r
+}
+
 func (st *Store) Clean(seqn int64) {
 	st.cleanCh <- seqn
 }
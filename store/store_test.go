@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"github.com/bmizerany/assert"
 	"sort"
 	"testing"
@@ -36,6 +37,13 @@ var GoodPaths = []string{
 	"/x/y-z",
 	"/x/y.z",
 	"/x/0",
+	"/x/y_z",
+	"/_",
+	"/café",
+	"/café",
+	"/ключ/значение",
+	"/世界",
+	"/x/٣",
 }
 
 var BadPaths = []string{
@@ -45,6 +53,13 @@ var BadPaths = []string{
 	"/x y",
 	"/x/",
 	"/x//y",
+	"/x:y",
+	"/x*",
+	"/x!",
+	"/x,y",
+	"/x\xff",
+	"/☃",
+	"/x\u00a0y",
 }
 
 var BadInstructions = []string{
@@ -61,6 +76,9 @@ var BadInstructions = []string{
 var BadMutations = []string{
 	"",
 	"x",
+	"+1:/x=a",
+	"01:/x=a",
+	"-0:/x",
 }
 
 var Splits = [][]string{
@@ -102,7 +120,41 @@ func TestCheckGoodPaths(t *testing.T) {
 	}
 }
 
+func TestEncodeDecodeAgree(t *testing.T) {
+	for _, k := range GoodPaths {
+		m, err := EncodeSet(k, "a:b=c", 5)
+		assert.Equalf(t, nil, err, "for path %q", k)
+		p, v, r, keep, err := decode(m)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, k, p)
+		assert.Equal(t, "a:b=c", v)
+		assert.Equal(t, int64(5), r)
+		assert.Equal(t, true, keep)
+
+		m, err = EncodeDel(k, Clobber)
+		assert.Equalf(t, nil, err, "for path %q", k)
+		p, _, r, keep, err = decode(m)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, k, p)
+		assert.Equal(t, Clobber, r)
+		assert.Equal(t, false, keep)
+
+		g, err := CompileGlob(k)
+		assert.Equalf(t, nil, err, "for path %q", k)
+		assert.Tf(t, g.Match(k), "glob %q should match itself", k)
+	}
+
+	for _, k := range BadPaths {
+		_, err := EncodeSet(k, "", Clobber)
+		assert.Equal(t, ErrBadPath, err)
+		_, err = EncodeDel(k, Clobber)
+		assert.Equal(t, ErrBadPath, err)
+	}
+}
+
 func TestEncodeSet(t *testing.T) {
+	TextMutations = true
+	defer func() { TextMutations = false }()
 	for _, x := range SetKVRM {
 		got, err := EncodeSet(x.k, x.v, x.r)
 		assert.Equal(t, nil, err)
@@ -110,6 +162,95 @@ func TestEncodeSet(t *testing.T) {
 	}
 }
 
+func TestEncodeBinary(t *testing.T) {
+	for _, x := range SetKVRM {
+		m, err := EncodeSet(x.k, x.v, x.r)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "\x00\x01", m[:2])
+
+		k, v, r, keep, err := decode(m)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, keep)
+		assert.Equal(t, x.k, k)
+		assert.Equal(t, x.v, v)
+		assert.Equal(t, x.r, r)
+	}
+
+	for _, x := range DelKVRM {
+		m, err := EncodeDel(x.k, x.r)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "\x00\x01", m[:2])
+
+		k, _, r, keep, err := decode(m)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, keep)
+		assert.Equal(t, x.k, k)
+		assert.Equal(t, x.r, r)
+	}
+}
+
+func TestDecodeUnknownVersion(t *testing.T) {
+	m := MustEncodeSet("/x", "a", Clobber)
+	_, _, _, _, err := decode("\x00\x02" + m[2:])
+	assert.Equal(t, ErrMutationVersion, err)
+}
+
+func TestDecodeBadBinary(t *testing.T) {
+	del := MustEncodeDel("/x", Clobber)
+	for _, m := range []string{
+		"\x00",
+		"\x00\x01\xff",
+		"\x00\x01",                       // no op
+		del[:len(del)-2],                 // truncated
+		MustEncodeDeltree("/x", Clobber), // not a set or del
+		MustEncodeSeq("/x", ""),          // not a set or del
+	} {
+		_, _, _, _, err := decode(m)
+		assert.Equalf(t, ErrBadMutation, err, "%q", m)
+	}
+}
+
+func TestEncodeSeq(t *testing.T) {
+	TextMutations = true
+	defer func() { TextMutations = false }()
+	for prefix, m := range map[string]string{
+		"/":       "seq:0:/=a",
+		"/q/":     "seq:0:/q/=a",
+		"/q/job-": "seq:0:/q/job-=a",
+	} {
+		got, err := EncodeSeq(prefix, "a")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, m, got)
+	}
+}
+
+func TestEncodeSeqBadPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "q", "/q//", "/q/="} {
+		_, err := EncodeSeq(prefix, "a")
+		assert.Equalf(t, ErrBadPath, err, "%q", prefix)
+	}
+}
+
+func TestSeqPath(t *testing.T) {
+	assert.Equal(t, "/q/job-0000000042", SeqPath("/q/job-", 42))
+	assert.Equal(t, "/q/12345678901", SeqPath("/q/", 12345678901))
+}
+
+func TestDecodeBadSeq(t *testing.T) {
+	for _, m := range []string{
+		"seq:0:/q//=a",
+		"seq:-1:/q/=a", // rev must be Missing
+		"seq:0:/q/",    // no body
+		"multi:11:seq:0:/q/=a",
+	} {
+		_, err := decodeMutation(m)
+		assert.Tf(t, err != nil, "%q", m)
+	}
+
+	_, err := EncodeMulti(MustEncodeSeq("/q/", "a"))
+	assert.Equal(t, ErrBadMutation, err)
+}
+
 func BenchmarkEncodeSet(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		EncodeSet("/x", "a", Clobber)
@@ -117,6 +258,8 @@ func BenchmarkEncodeSet(b *testing.B) {
 }
 
 func TestEncodeDel(t *testing.T) {
+	TextMutations = true
+	defer func() { TextMutations = false }()
 	for _, x := range DelKVRM {
 		got, err := EncodeDel(x.k, x.r)
 		assert.Equal(t, nil, err)
@@ -501,7 +644,7 @@ func TestWaitGlobOnPre(t *testing.T) {
 	st.Ops <- Op{3, mut3}
 
 	exp := clearGetter(<-ch)
-	assert.Equal(t, Event{1, "/x", "a", 1, mut1, nil, nil}, exp)
+	assert.Equal(t, Event{1, "/x", "a", 1, mut1, nil, nil, nil}, exp)
 }
 
 func TestWaitGlobAfterPre(t *testing.T) {
@@ -519,7 +662,7 @@ func TestWaitGlobAfterPre(t *testing.T) {
 	st.Ops <- Op{3, mut3}
 
 	exp := clearGetter(<-ch)
-	assert.Equal(t, Event{2, "/x", "b", 2, mut2, nil, nil}, exp)
+	assert.Equal(t, Event{2, "/x", "b", 2, mut2, nil, nil, nil}, exp)
 }
 
 func TestWaitGlobOnPost(t *testing.T) {
@@ -537,7 +680,7 @@ func TestWaitGlobOnPost(t *testing.T) {
 		panic(err)
 	}
 	exp := clearGetter(<-ch)
-	assert.Equal(t, Event{1, "/x", "a", 1, mut1, nil, nil}, exp)
+	assert.Equal(t, Event{1, "/x", "a", 1, mut1, nil, nil, nil}, exp)
 }
 
 func TestWaitGlobAfterPost(t *testing.T) {
@@ -555,7 +698,7 @@ func TestWaitGlobAfterPost(t *testing.T) {
 		panic(err)
 	}
 	exp := clearGetter(<-ch)
-	assert.Equal(t, Event{2, "/x", "b", 2, mut2, nil, nil}, exp)
+	assert.Equal(t, Event{2, "/x", "b", 2, mut2, nil, nil, nil}, exp)
 }
 
 func TestStoreNopEvent(t *testing.T) {
@@ -614,6 +757,36 @@ func TestWaitClose(t *testing.T) {
 	assert.Equal(t, 0, <-st.Waiting)
 }
 
+func TestUnwait(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	glob := MustCompileGlob("/x")
+	ch, err := st.Wait(glob, 1)
+	assert.Equal(t, nil, err)
+	other, _ := st.Wait(glob, 1)
+	assert.Equal(t, 2, <-st.Waiting)
+
+	st.Unwait(glob, ch)
+	_, ok := <-ch
+	assert.T(t, !ok)
+	assert.Equal(t, 1, <-st.Waiting)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	assert.Equal(t, int64(1), (<-other).Seqn)
+
+	// Once the event has been sent, there is nothing to unregister.
+	st.Unwait(glob, other)
+	assert.Equal(t, 0, <-st.Waiting)
+}
+
+func TestUnwaitClosed(t *testing.T) {
+	st := New()
+	ch, _ := st.Wait(Any, 1)
+	close(st.Ops)
+	st.Unwait(Any, ch) // must not block
+}
+
 func TestStoreWaitWorks(t *testing.T) {
 	st := New()
 	defer close(st.Ops)
@@ -727,7 +900,7 @@ func TestStoreKeepsLog(t *testing.T) {
 	st.Ops <- Op{1, mut}
 	ch, _ := st.Wait(Any, 1)
 	ev := <-ch
-	assert.Equal(t, Event{1, "/x", "a", 1, mut, nil, nil}, clearGetter(ev))
+	assert.Equal(t, Event{1, "/x", "a", 1, mut, nil, nil, nil}, clearGetter(ev))
 }
 
 func TestStoreClean(t *testing.T) {
@@ -750,3 +923,150 @@ func TestStoreSeqn(t *testing.T) {
 	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
 	assert.Equal(t, int64(1), <-st.Seqns)
 }
+
+func TestEncodeMultiEmpty(t *testing.T) {
+	_, err := EncodeMulti()
+	assert.Equal(t, ErrBadMutation, err)
+}
+
+func TestDecodeMulti(t *testing.T) {
+	TextMutations = true
+	defer func() { TextMutations = false }()
+	exp := []string{MustEncodeSet("/x", "a:b=c", Clobber), MustEncodeDel("/y", 5)}
+	m, err := EncodeMulti(exp...)
+	assert.Equal(t, nil, err)
+	got, err := decodeMulti(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, exp, got)
+}
+
+func TestWaitMulti(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	mut := MustEncodeSet("/x", "a", Clobber)
+	st.Ops <- Op{1, mut}
+
+	ch, err := st.Wait(MustCompileGlob("/y/*"), 2)
+	if err != nil {
+		panic(err)
+	}
+
+	m, _ := EncodeMulti(
+		MustEncodeSet("/x", "b", Clobber),
+		MustEncodeSet("/y/z", "c", Clobber),
+	)
+	st.Ops <- Op{2, m}
+	assert.Equal(t, Event{2, "/y/z", "c", 2, m, nil, nil, nil}, clearGetter(<-ch))
+}
+
+func TestWaitSkip(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/y/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/y/b", "1", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{4, MustEncodeDeltree("/", Clobber)}
+	st.Ops <- Op{5, MustEncodeSet("/y/c", "1", Clobber)}
+
+	glob := MustCompileGlob("/y/*")
+	var got []string
+	for rev, n := int64(4), 0; len(got) < 3; {
+		ch, err := st.WaitSkip(glob, rev, n)
+		if err != nil {
+			panic(err)
+		}
+		ev := <-ch
+		if ev.Seqn == rev {
+			n++
+		} else {
+			rev, n = ev.Seqn, 1
+		}
+		got = append(got, fmt.Sprintf("%d %s %s", ev.Seqn, ev.Desc(), ev.Path))
+	}
+	assert.Equal(t, []string{"4 del /y/a", "4 del /y/b", "5 set /y/c"}, got)
+}
+
+func TestWaitBraceGlob(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	a, err := st.Wait(MustCompileGlob("{/a,/b}"), 1)
+	assert.Equal(t, nil, err)
+	b, err := st.Wait(MustCompileGlob("/x{a,b}/c"), 1)
+	assert.Equal(t, nil, err)
+	st.Ops <- Op{1, MustEncodeSet("/b", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/xb/c", "1", Clobber)}
+	assert.Equal(t, "/b", (<-a).Path)
+	assert.Equal(t, "/xb/c", (<-b).Path)
+}
+
+func TestHistory(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	m, _ := EncodeMulti(MustEncodeSet("/a/x", "2", Clobber), MustEncodeSet("/a/y", "3", Clobber))
+	st.Ops <- Op{1, MustEncodeSet("/a/x", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/b", "1", Clobber)}
+	st.Ops <- Op{3, Nop}
+	st.Ops <- Op{4, m}
+	st.Ops <- Op{5, MustEncodeDel("/a/x", Clobber)}
+	sync(st, 5)
+
+	evs, next, err := st.History(MustCompileGlob("/a/*"), 1, 0, 100)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), next)
+	var got []string
+	for _, ev := range evs {
+		got = append(got, fmt.Sprintf("%d %s %s", ev.Seqn, ev.Desc(), ev.Path))
+	}
+	assert.Equal(t, []string{"1 set /a/x", "4 set /a/x", "4 set /a/y", "5 del /a/x"}, got)
+
+	evs, _, err = st.History(MustCompileGlob("/**"), 2, 3, 100)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(evs))
+	assert.Equal(t, "/b", evs[0].Path)
+}
+
+func TestHistoryClosed(t *testing.T) {
+	st := New()
+	close(st.Ops)
+	<-st.done
+
+	_, _, err := st.History(Any, 1, 0, 100)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestHistoryPages(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	m, _ := EncodeMulti(MustEncodeSet("/x", "2", Clobber), MustEncodeSet("/y", "2", Clobber))
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{2, m}
+	st.Ops <- Op{3, MustEncodeSet("/x", "3", Clobber)}
+	sync(st, 3)
+
+	evs, next, err := st.History(Any, 1, 0, 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(evs)) // a rev's changes are not split
+	assert.Equal(t, int64(3), next)
+
+	evs, next, err = st.History(Any, next, 0, 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(evs))
+	assert.Equal(t, "3", evs[0].Body)
+	assert.Equal(t, int64(0), next)
+}
+
+func TestHistoryTooLate(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "2", Clobber)}
+	sync(st, 2)
+	st.Clean(1)
+
+	_, _, err := st.History(Any, 1, 0, 10)
+	assert.Equal(t, ErrTooLate, err)
+	evs, _, err := st.History(Any, 2, 0, 10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(evs))
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	gosync "sync" // the tests define their own sync
+)
+
+// A Watch receives every change to a file matching its glob, in order,
+// on or after a given rev.
+//
+// A Watch reads from the store's history rather than having events
+// pushed to it, so a slow receiver holds up nothing but itself. If it
+// falls so far behind that the history it needs has been cleaned (see
+// Clean), C is closed and Err is set to ErrTooLate.
+type Watch struct {
+	C <-chan Event
+
+	// Set once C is closed. If Err is ErrTooLate, Rev is the first rev
+	// that could not be read. If Err is nil, the watch was stopped, or the
+	// store was closed.
+	Err error
+	Rev int64
+
+	st   *Store
+	glob *Glob
+	c    chan Event
+	stop chan bool
+	done chan bool // closed when run returns
+	once gosync.Once
+}
+
+// Returns a Watch that will receive each change made to any file matching
+// glob on or after rev.
+//
+// If rev is less than any value passed to st.Clean, Watch will return
+// ErrTooLate.
+func (st *Store) Watch(glob *Glob, rev int64) (*Watch, error) {
+	ch, err := st.wait(glob, rev, 0, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan Event)
+	w := &Watch{
+		C:    c,
+		st:   st,
+		glob: glob,
+		c:    c,
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	go w.run(ch)
+	return w, nil
+}
+
+// Stops w. C will be closed, possibly after sending one more event. Once
+// Stop returns, w no longer holds a wait on the store.
+func (w *Watch) Stop() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *Watch) run(ch <-chan Event) {
+	defer close(w.done)
+	defer close(w.c)
+
+	for {
+		var ev Event
+		var ok bool
+		select {
+		case ev, ok = <-ch:
+			if !ok {
+				return
+			}
+		case <-w.stop:
+			w.st.Unwait(w.glob, ch)
+			return
+		}
+
+		for _, c := range ev.matches(w.glob) {
+			select {
+			case w.c <- c:
+			case <-w.stop:
+				return
+			}
+		}
+
+		var err error
+		ch, err = w.st.wait(w.glob, ev.Seqn+1, 0, true)
+		if err != nil {
+			w.Err, w.Rev = err, ev.Seqn+1
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestWatchStream(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	w, err := st.Watch(MustCompileGlob("/x/*"), 1)
+	assert.Equal(t, nil, err)
+	defer w.Stop()
+
+	st.Ops <- Op{1, MustEncodeSet("/x/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/y", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/x/a", Clobber)}
+
+	ev := <-w.C
+	assert.Equal(t, int64(1), ev.Seqn)
+	assert.Equal(t, "/x/a", ev.Path)
+	assert.T(t, ev.IsSet())
+	ev = <-w.C
+	assert.Equal(t, int64(3), ev.Seqn)
+	assert.T(t, ev.IsDel())
+}
+
+func TestWatchFromHistory(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "2", Clobber)}
+	sync(st, 2)
+
+	w, err := st.Watch(MustCompileGlob("/x"), 1)
+	assert.Equal(t, nil, err)
+	defer w.Stop()
+	assert.Equal(t, "1", (<-w.C).Body)
+	assert.Equal(t, "2", (<-w.C).Body)
+}
+
+func TestWatchEveryChange(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	w, err := st.Watch(MustCompileGlob("/x/*"), 1)
+	assert.Equal(t, nil, err)
+	defer w.Stop()
+
+	m, _ := EncodeMulti(
+		MustEncodeSet("/x/a", "1", Clobber),
+		MustEncodeSet("/y", "2", Clobber),
+		MustEncodeSet("/x/b", "3", Clobber),
+	)
+	st.Ops <- Op{1, m}
+	st.Ops <- Op{2, MustEncodeSet("/x/c", "4", Clobber)}
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		paths = append(paths, (<-w.C).Path)
+	}
+	assert.Equal(t, []string{"/x/a", "/x/b", "/x/c"}, paths)
+}
+
+func TestWatchTooLate(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x", "3", Clobber)}
+	sync(st, 3)
+
+	w, err := st.Watch(MustCompileGlob("/x"), 1)
+	assert.Equal(t, nil, err)
+
+	// The receiver falls behind while history is cleaned.
+	st.Clean(2)
+	assert.Equal(t, "1", (<-w.C).Body)
+	for _ = range w.C {
+	}
+	assert.Equal(t, ErrTooLate, w.Err)
+	assert.Equal(t, int64(2), w.Rev)
+
+	_, err = st.Watch(MustCompileGlob("/x"), 1)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestWatchStop(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	w, err := st.Watch(MustCompileGlob("/x"), 1)
+	assert.Equal(t, nil, err)
+	w.Stop()
+	w.Stop()
+	_, ok := <-w.C
+	assert.T(t, !ok)
+	assert.Equal(t, nil, w.Err)
+	assert.Equal(t, 0, <-st.Waiting)
+}
@@ -0,0 +1,97 @@
+// Package ttl expires files at a wall-clock deadline.
+//
+// The deadline of a file is kept in the store, so every node agrees on
+// it:
+//
+//	/ctl/ttl/<x>  the deadline of the file whose path is hex-encoded as x,
+//	              in Unix nanoseconds
+//
+// A deadline is given the same rev as its file, and only applies while
+// the file keeps that rev. Once the deadline has passed, the first CAL
+// proposes deleting the file, guarded by that rev, so a file that has
+// changed in the meantime survives.
+package ttl
+
+import (
+	"encoding/hex"
+	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/member"
+	"github.com/ha/doozerd/store"
+	"log"
+	"strconv"
+	"time"
+)
+
+const Dir = "/ctl/ttl"
+
+func key(path string) string {
+	return Dir + "/" + hex.EncodeToString([]byte(path))
+}
+
+// Key returns a mutation that makes the file at path expire at deadline.
+// It must be applied together with the mutation that sets the file, as
+// part of a multi mutation, so the two have the same rev.
+func Key(path string, deadline int64) string {
+	return store.MustEncodeSet(key(path), strconv.FormatInt(deadline, 10), store.Clobber)
+}
+
+// Deadline returns the deadline of the file at path in g, in Unix
+// nanoseconds, or 0 if it has none.
+func Deadline(g store.Getter, path string) int64 {
+	_, rev := g.Get(path)
+	if rev <= 0 {
+		return 0
+	}
+
+	v, krev := g.Get(key(path))
+	if krev != rev {
+		return 0
+	}
+
+	n, _ := strconv.ParseInt(v[0], 10, 64)
+	return n
+}
+
+// Expire deletes each file whose deadline has passed, once per tick of
+// ticker, if self is the first CAL; see member.IsFirst.
+func Expire(st *store.Store, p consensus.Proposer, self string, ticker <-chan time.Time) {
+	for t := range ticker {
+		_, g := st.Snap()
+		if !member.IsFirst(g, self) {
+			continue
+		}
+
+		for _, muts := range expired(g, t.UnixNano()) {
+			e := consensus.Multi(p, muts)
+			if e.Err != nil {
+				log.Println(e.Err)
+			}
+		}
+	}
+}
+
+// Returns, for each deadline in g that has passed, the mutations that
+// delete it, along with its file if the file has not changed since.
+func expired(g store.Getter, now int64) (muts [][]string) {
+	for _, x := range store.Getdir(g, Dir) {
+		v, krev := g.Get(Dir + "/" + x)
+		if krev <= 0 {
+			continue
+		}
+
+		deadline, err := strconv.ParseInt(v[0], 10, 64)
+		if err == nil && deadline >= now {
+			continue
+		}
+
+		var m []string
+		b, err := hex.DecodeString(x)
+		if err == nil {
+			if _, rev := g.Get(string(b)); rev == krev {
+				m = append(m, store.MustEncodeDel(string(b), rev))
+			}
+		}
+		muts = append(muts, append(m, store.MustEncodeDel(Dir+"/"+x, krev)))
+	}
+	return muts
+}
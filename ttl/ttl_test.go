@@ -0,0 +1,68 @@
+package ttl
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/consensus"
+	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/test"
+	"testing"
+	"time"
+)
+
+func setTtl(p consensus.Proposer, path, body string, deadline int64) store.Event {
+	return consensus.Multi(p, []string{store.MustEncodeSet(path, body, store.Clobber), Key(path, deadline)})
+}
+
+func TestTtlDeadline(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+
+	assert.Equal(t, int64(0), Deadline(st, "/x"))
+	setTtl(fp, "/x", "a", 10)
+	assert.Equal(t, int64(10), Deadline(st, "/x"))
+
+	// Changing the file drops its deadline.
+	consensus.Set(fp, "/x", []byte("b"), store.Clobber)
+	assert.Equal(t, int64(0), Deadline(st, "/x"))
+}
+
+func TestTtlExpire(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	consensus.Set(fp, "/ctl/cal/0", []byte("me"), store.Clobber)
+
+	setTtl(fp, "/x", "a", 10)
+	setTtl(fp, "/y", "a", 10)
+	setTtl(fp, "/z", "a", 100)
+	consensus.Set(fp, "/y", []byte("b"), store.Clobber)
+
+	ticker := make(chan time.Time)
+	go Expire(st, fp, "me", ticker)
+	ticker <- time.Unix(0, 50)
+	ticker <- time.Unix(0, 50) // wait for the first tick to finish
+	close(ticker)
+
+	_, rev := st.Get("/x")
+	assert.Equal(t, store.Missing, rev)
+	assert.Equal(t, "b", store.GetString(st, "/y"))
+	assert.Equal(t, "a", store.GetString(st, "/z"))
+	assert.Equal(t, []string{key("/z")[len(Dir)+1:]}, store.Getdir(st, Dir))
+}
+
+func TestTtlExpireNotFirst(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	consensus.Set(fp, "/ctl/cal/0", []byte("other"), store.Clobber)
+	setTtl(fp, "/x", "a", 10)
+
+	ticker := make(chan time.Time)
+	go Expire(st, fp, "me", ticker)
+	ticker <- time.Unix(0, 50)
+	ticker <- time.Unix(0, 50)
+	close(ticker)
+
+	assert.Equal(t, "a", store.GetString(st, "/x"))
+}
@@ -0,0 +1,5 @@
+package web
+
+// This file was generated from web/diff.html.
+
+var diff_html string = "<html>\n  <head>\n    <title>{{ html .Name }} {{ html .Path }} diff {{ .A }}..{{ .B }}</title>\n    <link rel=stylesheet href=/$main.css>\n  </head>\n\n  <body>\n    <div id=info>\n      changes to {{ html .Path }} from rev {{ .A }} to rev {{ .B }}\n    </div>\n\n    <table class=diff>\n      <tr>\n        <th>path</th>\n        <th colspan=2>old</th>\n        <th colspan=2>new</th>\n      </tr>\n      {{ range .Diffs }}\n      <tr class=\"{{ if eq .OldRev 0 }}added{{ else if eq .NewRev 0 }}removed{{ else }}modified{{ end }}\">\n        <td>{{ html .Path }}</td>\n        <td class=rev>{{ if .OldRev }}({{ .OldRev }}){{ end }}</td>\n        <td class=body>{{ html .OldBody }}</td>\n        <td class=rev>{{ if .NewRev }}({{ .NewRev }}){{ end }}</td>\n        <td class=body>{{ html .NewBody }}</td>\n      </tr>\n      {{ else }}\n      <tr><td colspan=5>no changes</td></tr>\n      {{ end }}\n    </table>\n  </body>\n</html>\n"
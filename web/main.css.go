@@ -2,4 +2,4 @@ package web
 
 // This file was generated from web/main.css.
 
-var main_css string = "body {\n    color: #333;\n    font-family: monospace;\n}\n\n#info {\n    background: #ccc;\n    padding: .2em .4em;\n    margin: 0 0 1em;\n    -webkit-border-radius: .4em;\n    border-radius: .4em;\n}\n\n.error #info {\n    background: #d88;\n}\n\n.msg {\n    display: none;\n    background: #ee8;\n    -webkit-border-radius: .4em;\n    border-radius: .4em;\n    padding: 0 .3em;\n}\n\n.waiting #waiting.msg, .wereback #wereback.msg {\n    display: inline;\n}\n\na {\n    color: #35e;\n    cursor: pointer;\n    font-weight: bold;\n    text-decoration: underline;\n}\n\n#tree {\n    opacity: .5;\n}\n\n.open #tree {\n    opacity: 1;\n}\n\ndl {\n    margin: 0 0 0 .5em;\n    padding: 0;\n}\n\ndt {\n    font-weight: bold;\n    margin: 0;\n    padding: 0;\n}\n\ndd {\n    margin: 0 0 .5em;\n    padding: 0 0 0 1em;\n}\n\ntable {\n    border-spacing: 0;\n}\n\ntr {\n    -webkit-transition-property: background;\n    -webkit-transition-duration: 350ms;\n    -webkit-transition-timing-function: ease-in-out;\n    -moz-transition-property: background;\n    -moz-transition-duration: 350ms;\n    -moz-transition-timing-function: ease-in-out;\n    transition-property: background;\n    transition-duration: 350ms;\n    transition-timing-function: ease-in-out;\n}\n\ntr.new {\n    background: #f7f787;\n}\n\nth {\n    font-weight: normal;\n    margin: 0;\n    padding: 0 .5em;\n    text-align: left;\n}\n\ntd.eq:after {\n    content: \"=\";\n}\n\ntd {\n    margin: 0;\n    padding: 0 .5em;\n}\n\ntd.rev {\n    color: #aaa;\n    text-align: right;\n}\n\ntd.body {\n}\n"
+var main_css string = "body {\n    color: #333;\n    font-family: monospace;\n}\n\n#info {\n    background: #ccc;\n    padding: .2em .4em;\n    margin: 0 0 1em;\n    -webkit-border-radius: .4em;\n    border-radius: .4em;\n}\n\n.error #info {\n    background: #d88;\n}\n\n.msg {\n    display: none;\n    background: #ee8;\n    -webkit-border-radius: .4em;\n    border-radius: .4em;\n    padding: 0 .3em;\n}\n\n.waiting #waiting.msg, .wereback #wereback.msg {\n    display: inline;\n}\n\na {\n    color: #35e;\n    cursor: pointer;\n    font-weight: bold;\n    text-decoration: underline;\n}\n\n#tree {\n    opacity: .5;\n}\n\n.open #tree {\n    opacity: 1;\n}\n\ndl {\n    margin: 0 0 0 .5em;\n    padding: 0;\n}\n\ndt {\n    font-weight: bold;\n    margin: 0;\n    padding: 0;\n}\n\ndt span.dir {\n    color: #aaa;\n    font-weight: normal;\n}\n\ndd {\n    margin: 0 0 .5em;\n    padding: 0 0 0 1em;\n}\n\ntable {\n    border-spacing: 0;\n}\n\ntr {\n    -webkit-transition-property: background;\n    -webkit-transition-duration: 350ms;\n    -webkit-transition-timing-function: ease-in-out;\n    -moz-transition-property: background;\n    -moz-transition-duration: 350ms;\n    -moz-transition-timing-function: ease-in-out;\n    transition-property: background;\n    transition-duration: 350ms;\n    transition-timing-function: ease-in-out;\n}\n\ntr.new {\n    background: #f7f787;\n}\n\nth {\n    font-weight: normal;\n    margin: 0;\n    padding: 0 .5em;\n    text-align: left;\n}\n\ntd.eq:after {\n    content: \"=\";\n}\n\ntd {\n    margin: 0;\n    padding: 0 .5em;\n}\n\ntd.rev {\n    color: #aaa;\n    text-align: right;\n}\n\ntd.body {\n}\n\ntd.ttl {\n    color: #aaa;\n}\n\ntable.diff tr.added td.body {\n    color: #080;\n}\n\ntable.diff tr.removed td.body {\n    color: #a00;\n    text-decoration: line-through;\n}\n"
@@ -24,19 +24,23 @@ function apply(ev) {
   }
   parts = parts.slice(1); // omit leading empty string
   var dir_parts = parts.slice(0, parts.length - 1);
+  var dirs = ev.Dirs || [];
   var dir = $('#root');
+  dirinfo(dir.prev('dt'), dirs[0]);
   for (var i = 0; i < dir_parts.length; i++) {
     var part = dir_parts[i];
     var next = dir.find('> dl > div[name="'+part+'"] > dd');
     if (next.length < 1) {
       var div = $('<div>').attr('name', part);
       var dd = $('<dd>');
-      div.append($('<dt>').text(part+'/')).append(dd);
+      var dt = $('<dt>').text(part+'/ ').append('<span class=dir>');
+      div.append(dt).append(dd);
       insert(dir.children('dl'), div);
       dd.append('<dl>').append('<table><tbody>');
       next = dd;
     }
     dir = next;
+    dirinfo(dir.prev('dt'), dirs[i+1]);
   }
 
   var basename = parts[parts.length - 1];
@@ -47,23 +51,46 @@ function apply(ev) {
     tr.append($('<th>').text(basename)).
       append('<td class=rev>').
       append('<td class=eq>').
-      append('<td class=body>');
+      append('<td class=body>').
+      append('<td class=ttl>');
     entry = tr;
   }
   entry.children('td.rev').text('('+ev.Rev+')');
   entry.children('td.body').text(ev.Body);
+  entry.children('td.ttl').attr('deadline', ev.Deadline || '');
+  ttl(entry.children('td.ttl'));
   entry.addClass('new');
 
   // Kick off the transition in a bit.
   setTimeout(function() { entry.removeClass('new') }, 550);
 }
 
+// Shows when a directory was created and last had an entry added or
+// removed, and how many bytes are in it.
+function dirinfo(dt, d) {
+  if (!d) {
+    return;
+  }
+  dt.children('span.dir').text('(created '+d.Created+', changed '+d.Changed+', '+d.Bytes+' bytes)');
+}
+
 function time_interval(s) {
   if (s < 120) return Math.ceil(s) + 's';
   if (s < 7200) return Math.round(s/60) + 'm';
   return Math.round(s/3600) + 'h';
 }
 
+// Shows the time left before a file expires.
+function ttl(td) {
+  var deadline = td.attr('deadline');
+  if (!deadline) {
+    td.text('');
+    return;
+  }
+  var s = (deadline - new Date().getTime())/1000;
+  td.text('ttl ' + time_interval(Math.max(0, s)));
+}
+
 function countdown() {
   var body = $('body');
   var eta = (deadline - new Date().getTime())/1000;
@@ -121,6 +148,10 @@ function dr() {
     countdown();
   });
 
+  setInterval(function () {
+    $('td.ttl').each(function () { ttl($(this)) });
+  }, 1000);
+
   if ("WebSocket" in window) {
     open();
   } else {
@@ -4,11 +4,13 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
 	"github.com/ha/doozerd/store"
+	"github.com/ha/doozerd/ttl"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -16,9 +18,14 @@ import (
 var Store *store.Store
 var ClusterName string
 
+// If Locked is set, the web view refuses every request while it returns
+// true, as when the server's secrets are kept in the store.
+var Locked func() bool
+
 var (
 	mainTpl  = template.Must(template.New("main.html").Parse(main_html))
 	statsTpl = template.Must(template.New("stats.html").Parse(stats_html))
+	diffTpl  = template.Must(template.New("diff.html").Parse(diff_html))
 )
 
 type info struct {
@@ -26,6 +33,21 @@ type info struct {
 	Path string
 }
 
+type event struct {
+	store.Event
+	Deadline int64 // Unix milliseconds, or 0 if the file doesn't expire
+
+	// for each directory from the one being viewed down to the one
+	// holding the file
+	Dirs []dirInfo
+}
+
+type dirInfo struct {
+	Created int64
+	Changed int64
+	Bytes   int64
+}
+
 type stringHandler struct {
 	contentType string
 	body        string
@@ -36,22 +58,42 @@ func (sh stringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, sh.body)
 }
 
+type lockable struct {
+	http.Handler
+}
+
+func (h lockable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Locked != nil && Locked() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
 func Serve(listener net.Listener) {
 	http.HandleFunc("/", viewHtml)
 	http.HandleFunc("/$stats.html", statsHtml)
 	http.Handle("/$main.js", stringHandler{"application/javascript", main_js})
 	http.Handle("/$main.css", stringHandler{"text/css", main_css})
 	http.HandleFunc("/$events/", evServer)
+	http.HandleFunc("/$diff/", diffHtml)
 
-	http.Serve(listener, nil)
+	http.Serve(listener, lockable{http.DefaultServeMux})
 }
 
 func send(ws *websocket.Conn, path string, evs <-chan store.Event) {
-	l := len(path) - 1
+	dir := literalDir(path)
+	l := len(dir) - 1
 	for ev := range evs {
+		var d int64
+		var dirs []dirInfo
+		if ev.Getter != nil {
+			d = ttl.Deadline(ev.Getter, ev.Path) / 1e6
+			dirs = dirInfos(ev.Getter, dir, ev.Path)
+		}
 		ev.Getter = nil // don't marshal the entire snapshot
 		ev.Path = ev.Path[l:]
-		b, err := json.Marshal(ev)
+		b, err := json.Marshal(event{ev, d, dirs})
 		if err != nil {
 			log.Println(err)
 			return
@@ -64,6 +106,35 @@ func send(ws *websocket.Conn, path string, evs <-chan store.Event) {
 	}
 }
 
+// Returns what g holds about each directory from dir, which ends in a
+// slash, down to the one holding path.
+func dirInfos(g store.Getter, dir, path string) (a []dirInfo) {
+	for strings.HasPrefix(path, dir) {
+		p := dir
+		if p != "/" {
+			p = p[:len(p)-1]
+		}
+		created, changed := g.DirRevs(p)
+		_, bytes := g.Usage(p)
+		a = append(a, dirInfo{created, changed, bytes})
+
+		i := strings.Index(path[len(dir):], "/")
+		if i < 0 {
+			break
+		}
+		dir = path[:len(dir)+i+1]
+	}
+	return a
+}
+
+// Returns the part of path, up to a slash, before any glob notation.
+func literalDir(path string) string {
+	if i := strings.IndexAny(path, "*?[{!"); i >= 0 {
+		path = path[:i]
+	}
+	return path[:strings.LastIndex(path, "/")+1]
+}
+
 func evServer(w http.ResponseWriter, r *http.Request) {
 	wevs := make(chan store.Event)
 	path := r.URL.Path[len("/$events"):]
@@ -74,23 +145,39 @@ func evServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rev, _ := Store.Snap()
+	rev, g := Store.Snap()
+	wt, err := Store.Watch(glob, rev+1)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	defer wt.Stop()
+
+	done := make(chan bool)
+	defer close(done)
 
 	go func() {
-		walk(path, Store, wevs)
-		for {
-			ch, err := Store.Wait(glob, rev+1)
-			if err != nil {
-				break
+		defer close(wevs)
+		out := func(ev store.Event) bool {
+			select {
+			case wevs <- ev:
+				return true
+			case <-done:
+				return false
 			}
-			ev, ok := <-ch
-			if !ok {
-				break
+		}
+
+		stopped := store.Walk(g, glob, func(path, body string, rev int64) bool {
+			return !out(store.Event{0, path, body, rev, "", nil, nil, g})
+		})
+		if stopped {
+			return
+		}
+		for ev := range wt.C {
+			if !out(ev) {
+				return
 			}
-			wevs <- ev
-			rev = ev.Seqn
 		}
-		close(wevs)
 	}()
 
 	websocket.Handler(func(ws *websocket.Conn) {
@@ -111,27 +198,58 @@ func viewHtml(w http.ResponseWriter, r *http.Request) {
 	mainTpl.Execute(w, x)
 }
 
-func statsHtml(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("content-type", "text/html")
-	memstats := new(runtime.MemStats)
-	runtime.ReadMemStats(memstats)
-	statsTpl.Execute(w, *memstats)
+type diffInfo struct {
+	Name  string
+	Path  string
+	A, B  int64
+	Diffs []store.Difference
 }
 
-func walk(path string, st *store.Store, ch chan store.Event) {
-	for path != "/" && strings.HasSuffix(path, "/") {
-		// TODO generalize and factor this into pkg store.
-		path = path[0 : len(path)-1]
+// Shows what changed under a path, or glob, between revs a and b, as
+// in /$diff/config/?a=10&b=20. If b is missing, it means the current rev.
+func diffHtml(w http.ResponseWriter, r *http.Request) {
+	var x diffInfo
+	x.Name = ClusterName
+	x.Path = r.URL.Path[len("/$diff"):]
+
+	glob, err := store.CompileGlob(x.Path + "**")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
-	v, rev := st.Get(path)
-	if rev != store.Dir {
-		ch <- store.Event{0, path, v[0], rev, "", nil, nil}
+
+	x.A, err = strconv.ParseInt(r.FormValue("a"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad rev a", 400)
 		return
 	}
-	if path == "/" {
-		path = ""
+	ver, _ := Store.Snap()
+	x.B = ver
+	if s := r.FormValue("b"); s != "" {
+		x.B, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad rev b", 400)
+			return
+		}
 	}
-	for _, ent := range v {
-		walk(path+"/"+ent, st, ch)
+	if x.A > ver || x.B > ver {
+		http.Error(w, "no such rev yet", 404)
+		return
 	}
+
+	x.Diffs, err = Store.Diff(glob, x.A, x.B)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("content-type", "text/html")
+	diffTpl.Execute(w, x)
+}
+
+func statsHtml(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/html")
+	memstats := new(runtime.MemStats)
+	runtime.ReadMemStats(memstats)
+	statsTpl.Execute(w, *memstats)
 }
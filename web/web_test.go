@@ -1,6 +1,60 @@
 package web
 
-import "testing"
+import (
+	"github.com/bmizerany/assert"
+	"github.com/ha/doozerd/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
 
 func TestFoo(t *testing.T) {
 }
+
+func TestLiteralDir(t *testing.T) {
+	assert.Equal(t, "/", literalDir("/"))
+	assert.Equal(t, "/a/b/", literalDir("/a/b/"))
+	assert.Equal(t, "/svc/", literalDir("/svc/{web,api}/"))
+	assert.Equal(t, "/hosts/", literalDir("/hosts/[a-f]*/"))
+	assert.Equal(t, "/", literalDir("/a*/"))
+}
+
+func TestDiffHtml(t *testing.T) {
+	Store = store.New()
+	defer close(Store.Ops)
+	Store.Ops <- store.Op{1, store.MustEncodeSet("/config/x", "old", store.Clobber)}
+	Store.Ops <- store.Op{2, store.MustEncodeSet("/config/x", "<new>", store.Clobber)}
+	Store.Ops <- store.Op{3, store.MustEncodeSet("/other", "a", store.Clobber)}
+	<-Store.Seqns
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/$diff/config/?a=1&b=2", nil)
+	diffHtml(w, r)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.T(t, strings.Contains(body, "/config/x"), body)
+	assert.T(t, strings.Contains(body, "&lt;new&gt;"), body)
+	assert.T(t, !strings.Contains(body, "/other"), body)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/$diff/config/?a=1&b=99", nil)
+	diffHtml(w, r)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestDirInfos(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	st.Ops <- store.Op{1, store.MustEncodeSet("/a/b/c", "xy", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/a/d", "z", store.Clobber)}
+	<-st.Seqns
+
+	exp := []dirInfo{
+		{1, 2, 6}, // /a/
+		{1, 1, 3}, // /a/b/
+	}
+	assert.Equal(t, exp, dirInfos(st, "/a/", "/a/b/c"))
+	assert.Equal(t, exp[:1], dirInfos(st, "/a/", "/a/d"))
+	assert.Equal(t, 3, len(dirInfos(st, "/", "/a/b/c")))
+}